@@ -0,0 +1,111 @@
+package bastion
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type cleanupStep struct {
+	Description string
+	Cleanup     func() error
+}
+
+// cleanupStack records the resources created while launching a bastion so they
+// can be removed in reverse order if the launch fails or is interrupted
+type cleanupStack struct {
+	mu       sync.Mutex
+	steps    []cleanupStep
+	launched bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	signals  chan os.Signal
+}
+
+func NewCleanupStack() *cleanupStack {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &cleanupStack{
+		ctx:     ctx,
+		cancel:  cancel,
+		signals: make(chan os.Signal, 1),
+	}
+
+	// an interrupt cancels the context so any in-flight waiters return
+	// an error and the launch unwinds through the normal error path
+	signal.Notify(s.signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-s.signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return s
+}
+
+// Context is cancelled when an interrupt signal is received
+func (s *cleanupStack) Context() context.Context {
+	return s.ctx
+}
+
+func (s *cleanupStack) Push(description string, cleanup func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, cleanupStep{Description: description, Cleanup: cleanup})
+}
+
+// Unwind removes every recorded resource, most recently created first
+func (s *cleanupStack) Unwind() {
+	s.stop()
+
+	s.mu.Lock()
+	steps := s.steps
+	s.steps = nil
+	s.mu.Unlock()
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		err := steps[i].Cleanup()
+		if err != nil {
+			log.Printf("failed to clean up %s, %s", steps[i].Description, err)
+		}
+	}
+}
+
+// Release forgets the recorded resources so they outlive the command
+func (s *cleanupStack) Release() {
+	s.stop()
+
+	s.mu.Lock()
+	s.steps = nil
+	s.mu.Unlock()
+}
+
+// Launched marks the launch as complete, from then on the resources are kept by Finish when requested
+func (s *cleanupStack) Launched() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.launched = true
+}
+
+// Finish unwinds the stack unless the resources are meant to be kept, a launch that
+// failed or was interrupted before it completed is always unwound
+func (s *cleanupStack) Finish(keep bool) {
+	s.mu.Lock()
+	launched := s.launched
+	s.mu.Unlock()
+
+	if keep && launched {
+		s.Release()
+		return
+	}
+	s.Unwind()
+}
+
+func (s *cleanupStack) stop() {
+	signal.Stop(s.signals)
+	s.cancel()
+}
@@ -0,0 +1,316 @@
+package bastion
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const localConfigFile = ".bastion.yaml"
+
+// configFile holds flag values keyed by flag name, values in presets take
+// precedence over the AWS profile defaults which take precedence over the
+// global defaults
+type configFile struct {
+	Path     string                            `yaml:"-"`
+	Defaults map[string]configEntry            `yaml:"defaults"`
+	Profiles map[string]map[string]configEntry `yaml:"profiles"`
+	Presets  map[string]map[string]configEntry `yaml:"presets"`
+}
+
+// configEntry is the value of a flag, list flags such as forward can also be given a sequence of values
+type configEntry []string
+
+func (e *configEntry) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*e = configEntry{node.Value}
+		return nil
+	case yaml.SequenceNode:
+		var values []string
+		err := node.Decode(&values)
+		if err != nil {
+			return err
+		}
+		*e = values
+		return nil
+	default:
+		return fmt.Errorf("line %d: expected a value or a list of values", node.Line)
+	}
+}
+
+type configValue struct {
+	Values []string
+	Source string
+}
+
+// Value returns the values separated by commas, as they are given to list flags on the command line
+func (v configValue) Value() string {
+	return strings.Join(v.Values, ",")
+}
+
+// GetUserConfigPath returns ~/.config/bastion/config.yaml or the equivalent under $XDG_CONFIG_HOME
+func GetUserConfigPath() (string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(configHome, "bastion", "config.yaml"), nil
+}
+
+// FindLocalConfigPath searches the working directory and its parents for a .bastion.yaml file
+func FindLocalConfigPath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+
+	for {
+		path := filepath.Join(dir, localConfigFile)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func ReadConfigFile(path string) (*configFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &configFile{Path: path}
+	err = yaml.Unmarshal(b, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s, %s", path, err)
+	}
+
+	return config, nil
+}
+
+// LoadConfigFiles returns the repo-local config file followed by the user config file, missing files are skipped
+func LoadConfigFiles() ([]*configFile, error) {
+	var configs []*configFile
+	var paths []string
+
+	if path := FindLocalConfigPath(); path != "" {
+		paths = append(paths, path)
+	}
+
+	userConfigPath, err := GetUserConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, userConfigPath)
+
+	for _, path := range paths {
+		config, err := ReadConfigFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// ResolveConfig merges the config files into a single set of values for the preset and AWS profile
+func ResolveConfig(configs []*configFile, preset string, profile string) (map[string]configValue, error) {
+	resolved := map[string]configValue{}
+
+	merge := func(values map[string]configEntry, source string) {
+		for key, value := range values {
+			if _, ok := resolved[key]; !ok {
+				resolved[key] = configValue{Values: value, Source: source}
+			}
+		}
+	}
+
+	if preset != "" {
+		found := false
+		for _, config := range configs {
+			if values, ok := config.Presets[preset]; ok {
+				merge(values, fmt.Sprintf("preset %s (%s)", preset, config.Path))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("preset %s not found in any config file", preset)
+		}
+	}
+
+	// the preset or global defaults can choose the AWS profile whose defaults are applied
+	if profile == "" {
+		if v, ok := resolved["profile"]; ok {
+			profile = v.Value()
+		} else {
+			for _, config := range configs {
+				if v, ok := config.Defaults["profile"]; ok {
+					profile = configValue{Values: v}.Value()
+					break
+				}
+			}
+		}
+	}
+
+	if profile != "" {
+		for _, config := range configs {
+			merge(config.Profiles[profile], fmt.Sprintf("profile %s (%s)", profile, config.Path))
+		}
+	}
+
+	for _, config := range configs {
+		merge(config.Defaults, fmt.Sprintf("defaults (%s)", config.Path))
+	}
+
+	return resolved, nil
+}
+
+// ApplyConfig sets any flag not provided on the command line or through the environment from the config files
+func ApplyConfig(c *cli.Context) error {
+	configs, err := LoadConfigFiles()
+	if err != nil {
+		return err
+	}
+
+	if len(configs) == 0 {
+		if c.String("preset") != "" {
+			return errors.New("a preset was provided but no config file was found")
+		}
+		return nil
+	}
+
+	profile := ""
+	if c.IsSet("profile") {
+		profile = c.String("profile")
+	}
+
+	resolved, err := ResolveConfig(configs, c.String("preset"), profile)
+	if err != nil {
+		return err
+	}
+
+	for _, flag := range c.Command.Flags {
+		name := flag.Names()[0]
+		if name == "preset" || c.IsSet(name) {
+			continue
+		}
+
+		if v, ok := resolved[name]; ok {
+			if len(v.Values) > 1 && !IsListFlag(flag) {
+				return fmt.Errorf("%s from %s takes a single value, not a list", name, v.Source)
+			}
+
+			for _, value := range v.Values {
+				err = c.Set(name, value)
+				if err != nil {
+					return fmt.Errorf("invalid value %s for %s from %s, %s", value, name, v.Source, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsListFlag is true for flags that can be repeated, they are set once for each value in the config file
+func IsListFlag(flag cli.Flag) bool {
+	switch flag.(type) {
+	case *cli.StringSliceFlag, *cli.IntSliceFlag, *cli.Int64SliceFlag, *cli.Float64SliceFlag:
+		return true
+	}
+	return false
+}
+
+// ConfigEnvVar returns the environment variable of the flag a config key sets eg: BASTION_INSTANCE_TYPE for instance-type
+func ConfigEnvVar(key string) string {
+	return "BASTION_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+func CmdShowConfig(c *cli.Context) error {
+	configs, err := LoadConfigFiles()
+	if err != nil {
+		return err
+	}
+
+	profile := ""
+	if c.IsSet("profile") {
+		profile = c.String("profile")
+	}
+
+	resolved, err := ResolveConfig(configs, c.String("preset"), profile)
+	if err != nil {
+		return err
+	}
+
+	// flags and environment variables passed to this command take precedence over the config files
+	explicit := map[string]bool{}
+	for _, name := range c.LocalFlagNames() {
+		explicit[name] = true
+	}
+
+	for _, flag := range c.Command.Flags {
+		name := flag.Names()[0]
+		if name == "preset" || !c.IsSet(name) {
+			continue
+		}
+
+		source := "environment"
+		if explicit[name] {
+			source = "flag"
+		}
+		resolved[name] = configValue{Values: []string{c.String(name)}, Source: source}
+	}
+
+	// the other keys apply to commands this one doesn't share flags with, so
+	// look up the environment variable each of those commands would read
+	for key, v := range resolved {
+		if v.Source == "flag" || v.Source == "environment" {
+			continue
+		}
+
+		if value, ok := os.LookupEnv(ConfigEnvVar(key)); ok {
+			resolved[key] = configValue{Values: []string{value}, Source: "environment"}
+		}
+	}
+
+	var keys []string
+	for key := range resolved {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, config := range configs {
+		fmt.Printf("# using config file %s\n", config.Path)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, resolved[key].Value(), resolved[key].Source)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,149 @@
+package bastion
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveConfig(t *testing.T) {
+	local := &configFile{
+		Path: "local",
+		Defaults: map[string]configEntry{
+			"instance-type": {"t3.small"},
+		},
+		Profiles: map[string]map[string]configEntry{
+			"prod": {
+				"subnet-id": {"subnet-local"},
+			},
+		},
+		Presets: map[string]map[string]configEntry{
+			"db": {
+				"profile":     {"prod"},
+				"remote-port": {"5432"},
+				"forward":     {"5432:db1:5432", "5433:db2:5432"},
+			},
+		},
+	}
+	user := &configFile{
+		Path: "user",
+		Defaults: map[string]configEntry{
+			"instance-type": {"t3.micro"},
+			"region":        {"ap-southeast-2"},
+		},
+		Profiles: map[string]map[string]configEntry{
+			"prod": {
+				"subnet-id":     {"subnet-user"},
+				"instance-type": {"t3.large"},
+				"no-spot":       {"true"},
+			},
+			"dev": {
+				"subnet-id": {"subnet-dev"},
+			},
+		},
+		Presets: map[string]map[string]configEntry{
+			"db": {
+				"remote-port": {"3306"},
+				"region":      {"us-east-1"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		configs  []*configFile
+		preset   string
+		profile  string
+		expected map[string]configValue
+	}{
+		{
+			name:    "defaults only",
+			configs: []*configFile{local, user},
+			expected: map[string]configValue{
+				"instance-type": {Values: []string{"t3.small"}, Source: "defaults (local)"},
+				"region":        {Values: []string{"ap-southeast-2"}, Source: "defaults (user)"},
+			},
+		},
+		{
+			name:    "preset over profile over defaults with the profile chosen by the preset",
+			configs: []*configFile{local, user},
+			preset:  "db",
+			expected: map[string]configValue{
+				"profile":       {Values: []string{"prod"}, Source: "preset db (local)"},
+				"remote-port":   {Values: []string{"5432"}, Source: "preset db (local)"},
+				"forward":       {Values: []string{"5432:db1:5432", "5433:db2:5432"}, Source: "preset db (local)"},
+				"region":        {Values: []string{"us-east-1"}, Source: "preset db (user)"},
+				"subnet-id":     {Values: []string{"subnet-local"}, Source: "profile prod (local)"},
+				"instance-type": {Values: []string{"t3.large"}, Source: "profile prod (user)"},
+				"no-spot":       {Values: []string{"true"}, Source: "profile prod (user)"},
+			},
+		},
+		{
+			name:    "profile given on the command line",
+			configs: []*configFile{local, user},
+			profile: "dev",
+			expected: map[string]configValue{
+				"subnet-id":     {Values: []string{"subnet-dev"}, Source: "profile dev (user)"},
+				"instance-type": {Values: []string{"t3.small"}, Source: "defaults (local)"},
+				"region":        {Values: []string{"ap-southeast-2"}, Source: "defaults (user)"},
+			},
+		},
+		{
+			name:    "user file only",
+			configs: []*configFile{user},
+			expected: map[string]configValue{
+				"instance-type": {Values: []string{"t3.micro"}, Source: "defaults (user)"},
+				"region":        {Values: []string{"ap-southeast-2"}, Source: "defaults (user)"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := ResolveConfig(tt.configs, tt.preset, tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resolved, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, resolved)
+			}
+		})
+	}
+}
+
+func TestResolveConfigMissingPreset(t *testing.T) {
+	_, err := ResolveConfig([]*configFile{{Path: "user"}}, "missing", "")
+	if err == nil {
+		t.Fatal("expected an error for a preset that isn't defined")
+	}
+}
+
+func TestConfigValue(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected string
+	}{
+		{values: []string{"t3.small"}, expected: "t3.small"},
+		{values: []string{"a", "b"}, expected: "a,b"},
+		{values: nil, expected: ""},
+	}
+
+	for _, tt := range tests {
+		if got := (configValue{Values: tt.values}).Value(); got != tt.expected {
+			t.Errorf("expected %q for %v, got %q", tt.expected, tt.values, got)
+		}
+	}
+}
+
+func TestConfigEnvVar(t *testing.T) {
+	tests := map[string]string{
+		"instance-type":        "BASTION_INSTANCE_TYPE",
+		"region":               "BASTION_REGION",
+		"no-volume-encryption": "BASTION_NO_VOLUME_ENCRYPTION",
+	}
+
+	for key, expected := range tests {
+		if got := ConfigEnvVar(key); got != expected {
+			t.Errorf("expected %s for %s, got %s", expected, key, got)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+// Package datachannel implements the client side of the AWS Systems Manager
+// Session Manager data channel, the websocket protocol the session manager
+// plugin speaks to the SSM agent, so sessions can be started without the plugin
+package datachannel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// ClientVersion is reported to the agent during the handshake. Versions of the
+// plugin before 1.1.70 do not multiplex port sessions so the agent forwards a
+// single connection per session as a plain byte stream, multiplexing isn't
+// implemented so every connection needs a session of its own
+const ClientVersion = "1.1.61.0"
+
+// streamDataPayloadSize is the largest payload sent in a single message
+const streamDataPayloadSize = 1024
+
+const pingInterval = 5 * time.Minute
+
+// outgoingBufferCapacity is the number of unacknowledged input messages held before writes block
+const outgoingBufferCapacity = 10000
+
+// resendMaxAttempts is the number of times a message is resent before the channel is closed
+const resendMaxAttempts = 300
+
+// resendTimeout is how long an input message waits for an acknowledgement before it is resent,
+// the agent drops messages when its buffer is full and relies on the client resending them
+var resendTimeout = time.Second
+
+var ErrEncryptionNotSupported = errors.New("the session requires KMS encryption which is not supported by the built in session client, use --session-manager-plugin")
+
+// DataChannel is a Session Manager session, reads return the output of the
+// session and writes are sent to the session as input
+type DataChannel struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	sequence int64
+	expected int64
+	incoming map[int64]*ClientMessage
+
+	// outgoing holds the input messages until they are acknowledged, keyed by sequence number.
+	// publish is signalled when a message is acknowledged, publication resumes or the channel closes
+	outgoingMu sync.Mutex
+	outgoing   map[int64]*outgoingMessage
+	paused     bool
+	publish    *sync.Cond
+
+	resendTimeout time.Duration
+
+	reader *io.PipeReader
+	writer *io.PipeWriter
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	// CloseMessage holds the reason given by the agent when it closed the channel
+	CloseMessage string
+}
+
+// outgoingMessage is an input message waiting to be acknowledged by the agent
+type outgoingMessage struct {
+	message  *ClientMessage
+	sentAt   time.Time
+	attempts int
+}
+
+// Open connects to the stream url returned by StartSession and authenticates with the session token
+func Open(streamUrl string, token string) (*DataChannel, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(streamUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the session data channel, %s", err)
+	}
+
+	input := openDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestId:            uuid.New().String(),
+		TokenValue:           token,
+		ClientId:             uuid.New().String(),
+		ClientVersion:        ClientVersion,
+	}
+
+	err = ws.WriteJSON(input)
+	if err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("unable to open the session data channel, %s", err)
+	}
+
+	reader, writer := io.Pipe()
+	d := &DataChannel{
+		ws:       ws,
+		incoming: map[int64]*ClientMessage{},
+		outgoing: map[int64]*outgoingMessage{},
+		reader:   reader,
+		writer:   writer,
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+
+		resendTimeout: resendTimeout,
+	}
+
+	d.publish = sync.NewCond(&d.outgoingMu)
+
+	go d.readLoop()
+	go d.pingLoop()
+	go d.resendLoop()
+
+	return d, nil
+}
+
+// Read returns the output of the session, io.EOF is returned once the agent closes the channel
+func (d *DataChannel) Read(p []byte) (int, error) {
+	return d.reader.Read(p)
+}
+
+// Write sends input to the session once the handshake with the agent has completed, it blocks
+// while the agent has paused publication or too many messages are waiting to be acknowledged
+func (d *DataChannel) Write(p []byte) (int, error) {
+	err := d.waitReady()
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for written < len(p) {
+		end := written + streamDataPayloadSize
+		if end > len(p) {
+			end = len(p)
+		}
+
+		err = d.waitPublish()
+		if err != nil {
+			return written, err
+		}
+
+		err = d.sendInput(Output, p[written:end])
+		if err != nil {
+			return written, err
+		}
+		written = end
+	}
+
+	return written, nil
+}
+
+// SetSize sends the terminal dimensions for shell sessions
+func (d *DataChannel) SetSize(cols, rows int) error {
+	err := d.waitReady()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(sizeData{Cols: uint32(cols), Rows: uint32(rows)})
+	if err != nil {
+		return err
+	}
+
+	return d.sendInput(Size, payload)
+}
+
+// SendFlag sends a port session flag such as DisconnectToPort to the agent
+func (d *DataChannel) SendFlag(flag PayloadTypeFlag) error {
+	err := d.waitReady()
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(flag))
+
+	return d.sendInput(Flag, payload)
+}
+
+// Ready is closed once the handshake has completed and input can be sent
+func (d *DataChannel) Ready() <-chan struct{} {
+	return d.ready
+}
+
+// Done is closed when the channel has been closed by either side
+func (d *DataChannel) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns the error that closed the channel, nil if it was closed normally
+func (d *DataChannel) Err() error {
+	<-d.done
+	return d.err
+}
+
+// Close closes the websocket, the session itself should be terminated with the SSM api
+func (d *DataChannel) Close() error {
+	d.shutdown(nil)
+	return nil
+}
+
+func (d *DataChannel) waitReady() error {
+	select {
+	case <-d.ready:
+		return nil
+	case <-d.done:
+		return d.closedErr()
+	}
+}
+
+// waitPublish blocks until the agent accepts more input
+func (d *DataChannel) waitPublish() error {
+	d.outgoingMu.Lock()
+	defer d.outgoingMu.Unlock()
+
+	for d.paused || len(d.outgoing) >= outgoingBufferCapacity {
+		select {
+		case <-d.done:
+			return d.closedErr()
+		default:
+		}
+		d.publish.Wait()
+	}
+
+	select {
+	case <-d.done:
+		return d.closedErr()
+	default:
+		return nil
+	}
+}
+
+func (d *DataChannel) closedErr() error {
+	if d.err != nil {
+		return d.err
+	}
+	return io.ErrClosedPipe
+}
+
+func (d *DataChannel) markReady() {
+	d.readyOnce.Do(func() { close(d.ready) })
+}
+
+func (d *DataChannel) shutdown(err error) {
+	d.closeOnce.Do(func() {
+		d.err = err
+		close(d.done)
+
+		d.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		d.ws.Close()
+
+		if err != nil {
+			d.writer.CloseWithError(err)
+		} else {
+			d.writer.Close()
+		}
+
+		// wake writes waiting for publication
+		d.outgoingMu.Lock()
+		d.publish.Broadcast()
+		d.outgoingMu.Unlock()
+	})
+}
+
+// send writes a message to the websocket, the caller must hold writeMu
+func (d *DataChannel) send(m *ClientMessage) error {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return d.ws.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// sendInput sends an input_stream_data message, every input message including
+// the handshake response shares the one sequence. The message is kept until the
+// agent acknowledges it so it can be resent
+func (d *DataChannel) sendInput(payloadType PayloadType, payload []byte) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	flags := FlagData
+	if d.sequence == 0 {
+		flags = FlagSyn
+	}
+
+	m := &ClientMessage{
+		MessageType:    InputStreamMessage,
+		SchemaVersion:  1,
+		CreatedDate:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		SequenceNumber: d.sequence,
+		Flags:          flags,
+		MessageId:      uuid.New(),
+		PayloadType:    payloadType,
+		Payload:        append([]byte(nil), payload...),
+	}
+
+	d.outgoingMu.Lock()
+	d.outgoing[m.SequenceNumber] = &outgoingMessage{message: m, sentAt: time.Now()}
+	d.outgoingMu.Unlock()
+
+	d.sequence++
+
+	return d.send(m)
+}
+
+// acknowledged removes an input message once the agent has received it
+func (d *DataChannel) acknowledged(m *ClientMessage) {
+	var ack acknowledgeContent
+	if err := json.Unmarshal(m.Payload, &ack); err != nil {
+		return
+	}
+
+	d.outgoingMu.Lock()
+	defer d.outgoingMu.Unlock()
+
+	delete(d.outgoing, ack.SequenceNumber)
+	d.publish.Broadcast()
+}
+
+func (d *DataChannel) setPaused(paused bool) {
+	d.outgoingMu.Lock()
+	defer d.outgoingMu.Unlock()
+
+	d.paused = paused
+	d.publish.Broadcast()
+}
+
+// resendLoop resends the input messages that haven't been acknowledged within the resend timeout
+func (d *DataChannel) resendLoop() {
+	ticker := time.NewTicker(d.resendTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+
+		d.outgoingMu.Lock()
+		var due []*outgoingMessage
+		for _, pending := range d.outgoing {
+			if time.Since(pending.sentAt) >= d.resendTimeout {
+				due = append(due, pending)
+			}
+		}
+		d.outgoingMu.Unlock()
+
+		sort.Slice(due, func(i, j int) bool {
+			return due[i].message.SequenceNumber < due[j].message.SequenceNumber
+		})
+
+		for _, pending := range due {
+			if pending.attempts >= resendMaxAttempts {
+				d.shutdown(fmt.Errorf("the agent didn't acknowledge message %d after %d attempts", pending.message.SequenceNumber, resendMaxAttempts))
+				return
+			}
+
+			d.writeMu.Lock()
+			err := d.send(pending.message)
+			d.writeMu.Unlock()
+			if err != nil {
+				d.shutdown(err)
+				return
+			}
+
+			d.outgoingMu.Lock()
+			pending.attempts++
+			pending.sentAt = time.Now()
+			d.outgoingMu.Unlock()
+		}
+	}
+}
+
+func (d *DataChannel) acknowledge(m *ClientMessage) error {
+	payload, err := json.Marshal(acknowledgeContent{
+		MessageType:         m.MessageType,
+		MessageId:           m.MessageId.String(),
+		SequenceNumber:      m.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	return d.send(&ClientMessage{
+		MessageType:   AcknowledgeMessage,
+		SchemaVersion: 1,
+		CreatedDate:   uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		Flags:         FlagAck,
+		MessageId:     uuid.New(),
+		Payload:       payload,
+	})
+}
+
+func (d *DataChannel) readLoop() {
+	for {
+		messageType, b, err := d.ws.ReadMessage()
+		if err != nil {
+			select {
+			case <-d.done:
+			default:
+				d.shutdown(fmt.Errorf("session data channel closed unexpectedly, %s", err))
+			}
+			return
+		}
+
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		m := &ClientMessage{}
+		if err := m.UnmarshalBinary(b); err != nil {
+			// the agent resends anything that is not acknowledged
+			continue
+		}
+
+		switch m.MessageType {
+		case OutputStreamMessage:
+			err = d.acknowledge(m)
+			if err != nil {
+				d.shutdown(err)
+				return
+			}
+
+			// messages can be resent or arrive out of order, they are
+			// buffered until every earlier message has been handled
+			if m.SequenceNumber < d.expected {
+				continue
+			}
+			d.incoming[m.SequenceNumber] = m
+
+			for {
+				next, ok := d.incoming[d.expected]
+				if !ok {
+					break
+				}
+				delete(d.incoming, d.expected)
+				d.expected++
+
+				err = d.handleOutput(next)
+				if err != nil {
+					d.shutdown(err)
+					return
+				}
+			}
+		case AcknowledgeMessage:
+			d.acknowledged(m)
+		case PausePublicationMessage:
+			d.setPaused(true)
+		case StartPublicationMessage:
+			d.setPaused(false)
+		case ChannelClosedMessage:
+			var closed channelClosed
+			if err := json.Unmarshal(m.Payload, &closed); err == nil {
+				d.CloseMessage = closed.Output
+			}
+			d.shutdown(nil)
+			return
+		}
+	}
+}
+
+func (d *DataChannel) handleOutput(m *ClientMessage) error {
+	switch m.PayloadType {
+	case HandshakeRequest:
+		return d.handshake(m.Payload)
+	case HandshakeComplete:
+		d.markReady()
+	case Output, StdErr:
+		// agents that predate the handshake start sending output straight away
+		d.markReady()
+		_, err := d.writer.Write(m.Payload)
+		if err == io.ErrClosedPipe {
+			return nil
+		}
+		return err
+	case Flag:
+		if len(m.Payload) >= 4 && PayloadTypeFlag(binary.BigEndian.Uint32(m.Payload)) == ConnectToPortError {
+			return errors.New("the bastion was unable to connect to the remote port")
+		}
+	}
+
+	return nil
+}
+
+// handshake accepts the session type and declines KMS encryption which is not implemented
+func (d *DataChannel) handshake(payload []byte) error {
+	var request handshakeRequest
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return fmt.Errorf("invalid handshake request from the agent, %s", err)
+	}
+
+	response := handshakeResponse{
+		ClientVersion: ClientVersion,
+		Errors:        []string{},
+	}
+
+	var handshakeErr error
+	for _, action := range request.RequestedClientActions {
+		processed := processedClientAction{ActionType: action.ActionType}
+		switch action.ActionType {
+		case sessionTypeAction:
+			processed.ActionStatus = actionSuccess
+		case kmsEncryptionAction:
+			processed.ActionStatus = actionFailed
+			processed.Error = ErrEncryptionNotSupported.Error()
+			response.Errors = append(response.Errors, processed.Error)
+			handshakeErr = ErrEncryptionNotSupported
+		default:
+			processed.ActionStatus = actionUnsupported
+			processed.Error = fmt.Sprintf("unsupported action %s", action.ActionType)
+		}
+		response.ProcessedClientActions = append(response.ProcessedClientActions, processed)
+	}
+
+	b, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	err = d.sendInput(HandshakeResponse, b)
+	if err != nil {
+		return err
+	}
+
+	return handshakeErr
+}
+
+func (d *DataChannel) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.ws.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(10*time.Second))
+		case <-d.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package datachannel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// agent is the agent side of a data channel served by a local websocket stand-in
+type agent struct {
+	t        *testing.T
+	ws       *websocket.Conn
+	open     openDataChannelInput
+	sequence int64
+}
+
+// startAgent opens a data channel to a local websocket server and returns both ends
+func startAgent(t *testing.T) (*DataChannel, *agent) {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("unable to upgrade, %s", err)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(server.Close)
+
+	d, err := Open("ws"+strings.TrimPrefix(server.URL, "http"), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &agent{t: t, ws: <-conns}
+	t.Cleanup(func() {
+		d.Close()
+		a.ws.Close()
+	})
+
+	a.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, b, err := a.ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.TextMessage {
+		t.Fatalf("expected the open data channel input as a text frame, got %d", messageType)
+	}
+	err = json.Unmarshal(b, &a.open)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, a
+}
+
+// sendOutput sends an output_stream_data message with the next sequence number
+func (a *agent) sendOutput(payloadType PayloadType, payload []byte) *ClientMessage {
+	a.t.Helper()
+
+	m := a.sendOutputSequence(a.sequence, payloadType, payload)
+	a.sequence++
+	return m
+}
+
+func (a *agent) sendOutputSequence(sequence int64, payloadType PayloadType, payload []byte) *ClientMessage {
+	a.t.Helper()
+
+	m := &ClientMessage{
+		MessageType:    OutputStreamMessage,
+		SchemaVersion:  1,
+		SequenceNumber: sequence,
+		MessageId:      uuid.New(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+	a.send(m)
+	return m
+}
+
+func (a *agent) send(m *ClientMessage) {
+	a.t.Helper()
+
+	b, err := m.MarshalBinary()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	err = a.ws.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+func (a *agent) sendJSON(messageType string, content interface{}) {
+	a.t.Helper()
+
+	payload, err := json.Marshal(content)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	a.send(&ClientMessage{MessageType: messageType, SchemaVersion: 1, MessageId: uuid.New(), Payload: payload})
+}
+
+func (a *agent) acknowledge(m *ClientMessage) {
+	a.t.Helper()
+
+	a.sendJSON(AcknowledgeMessage, acknowledgeContent{
+		MessageType:         m.MessageType,
+		MessageId:           m.MessageId.String(),
+		SequenceNumber:      m.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+}
+
+func (a *agent) read() *ClientMessage {
+	a.t.Helper()
+
+	a.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, b, err := a.ws.ReadMessage()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	m := &ClientMessage{}
+	err = m.UnmarshalBinary(b)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return m
+}
+
+// readAck returns the acknowledged sequence number of the next message
+func (a *agent) readAck() int64 {
+	a.t.Helper()
+
+	m := a.read()
+	if m.MessageType != AcknowledgeMessage {
+		a.t.Fatalf("expected %s, got %s", AcknowledgeMessage, m.MessageType)
+	}
+
+	var ack acknowledgeContent
+	err := json.Unmarshal(m.Payload, &ack)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return ack.SequenceNumber
+}
+
+// readInput returns the next input message skipping acknowledgements
+func (a *agent) readInput() *ClientMessage {
+	a.t.Helper()
+
+	for {
+		m := a.read()
+		if m.MessageType == AcknowledgeMessage {
+			continue
+		}
+		if m.MessageType != InputStreamMessage {
+			a.t.Fatalf("expected %s, got %s", InputStreamMessage, m.MessageType)
+		}
+		return m
+	}
+}
+
+// complete finishes the handshake so the client can send input
+func (a *agent) complete(d *DataChannel) {
+	a.t.Helper()
+
+	payload, _ := json.Marshal(handshakeComplete{})
+	a.sendOutput(HandshakeComplete, payload)
+	a.readAck()
+
+	select {
+	case <-d.Ready():
+	case <-time.After(5 * time.Second):
+		a.t.Fatal("the data channel didn't become ready")
+	}
+}
+
+func readDone(t *testing.T, d *DataChannel) {
+	t.Helper()
+
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the data channel wasn't closed")
+	}
+}
+
+func TestOpenAndHandshake(t *testing.T) {
+	d, a := startAgent(t)
+
+	if a.open.TokenValue != "token" {
+		t.Errorf("expected the session token, got %q", a.open.TokenValue)
+	}
+	if a.open.ClientVersion != ClientVersion || a.open.MessageSchemaVersion != "1.0" {
+		t.Errorf("unexpected open data channel input %+v", a.open)
+	}
+
+	payload, _ := json.Marshal(handshakeRequest{
+		AgentVersion: "3.1.0.0",
+		RequestedClientActions: []requestedClientAction{
+			{ActionType: sessionTypeAction, ActionParameters: json.RawMessage(`{"SessionType":"Port"}`)},
+		},
+	})
+	a.sendOutput(HandshakeRequest, payload)
+
+	if sequence := a.readAck(); sequence != 0 {
+		t.Errorf("expected the handshake request to be acknowledged, got sequence %d", sequence)
+	}
+
+	m := a.readInput()
+	if m.PayloadType != HandshakeResponse || m.SequenceNumber != 0 || m.Flags != FlagSyn {
+		t.Fatalf("expected the handshake response as the first input message, got %+v", m)
+	}
+
+	var response handshakeResponse
+	err := json.Unmarshal(m.Payload, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.ProcessedClientActions) != 1 || response.ProcessedClientActions[0].ActionStatus != actionSuccess {
+		t.Errorf("expected the session type to be accepted, got %+v", response.ProcessedClientActions)
+	}
+
+	a.complete(d)
+}
+
+func TestHandshakeDeclinesKMSEncryption(t *testing.T) {
+	d, a := startAgent(t)
+
+	payload, _ := json.Marshal(handshakeRequest{
+		RequestedClientActions: []requestedClientAction{
+			{ActionType: sessionTypeAction},
+			{ActionType: kmsEncryptionAction, ActionParameters: json.RawMessage(`{"KMSKeyId":"key"}`)},
+		},
+	})
+	a.sendOutput(HandshakeRequest, payload)
+
+	var response handshakeResponse
+	err := json.Unmarshal(a.readInput().Payload, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.ProcessedClientActions) != 2 || response.ProcessedClientActions[1].ActionStatus != actionFailed {
+		t.Errorf("expected KMS encryption to be declined, got %+v", response.ProcessedClientActions)
+	}
+	if len(response.Errors) != 1 {
+		t.Errorf("expected the declined action in the errors, got %v", response.Errors)
+	}
+
+	readDone(t, d)
+	if d.Err() != ErrEncryptionNotSupported {
+		t.Errorf("expected ErrEncryptionNotSupported, got %v", d.Err())
+	}
+}
+
+func TestOutputReorderedAndDeduplicated(t *testing.T) {
+	d, a := startAgent(t)
+
+	//output isn't buffered so it is read while the acknowledgements are checked
+	output := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 3)
+		io.ReadFull(d, b)
+		output <- b
+	}()
+
+	a.sendOutputSequence(1, Output, []byte("b"))
+	a.sendOutputSequence(0, Output, []byte("a"))
+	a.sendOutputSequence(1, Output, []byte("b"))
+	a.sendOutputSequence(0, Output, []byte("a"))
+	a.sendOutputSequence(2, Output, []byte("c"))
+
+	for i, expected := range []int64{1, 0, 1, 0, 2} {
+		if sequence := a.readAck(); sequence != expected {
+			t.Errorf("expected ack %d for sequence %d, got %d", i, expected, sequence)
+		}
+	}
+
+	select {
+	case b := <-output:
+		if string(b) != "abc" {
+			t.Errorf("expected the output in sequence order once, got %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the output to be read")
+	}
+
+	a.sendJSON(ChannelClosedMessage, channelClosed{})
+	readDone(t, d)
+
+	rest, _ := ioutil.ReadAll(d)
+	if len(rest) != 0 {
+		t.Errorf("expected no duplicated output, got %q", rest)
+	}
+}
+
+func TestConnectToPortError(t *testing.T) {
+	d, a := startAgent(t)
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(ConnectToPortError))
+	a.sendOutput(Flag, payload)
+
+	readDone(t, d)
+	if d.Err() == nil {
+		t.Error("expected the connect to port error to close the channel with an error")
+	}
+}
+
+func TestChannelClosed(t *testing.T) {
+	d, a := startAgent(t)
+
+	a.sendJSON(ChannelClosedMessage, channelClosed{Output: "session terminated"})
+
+	readDone(t, d)
+	if d.Err() != nil {
+		t.Errorf("expected the channel to close without an error, got %v", d.Err())
+	}
+	if d.CloseMessage != "session terminated" {
+		t.Errorf("expected the close message, got %q", d.CloseMessage)
+	}
+
+	_, err := d.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected io.EOF once closed, got %v", err)
+	}
+}
+
+func TestInputResentUntilAcknowledged(t *testing.T) {
+	timeout := resendTimeout
+	resendTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { resendTimeout = timeout })
+
+	d, a := startAgent(t)
+	a.complete(d)
+
+	_, err := d.Write([]byte("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := a.readInput()
+	resent := a.readInput()
+	if resent.MessageId != first.MessageId || resent.SequenceNumber != first.SequenceNumber || string(resent.Payload) != "input" {
+		t.Fatalf("expected the unacknowledged message to be resent, got %+v", resent)
+	}
+
+	a.acknowledge(first)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.outgoingMu.Lock()
+		pending := len(d.outgoing)
+		d.outgoingMu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the acknowledged message to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteBlocksWhilePaused(t *testing.T) {
+	d, a := startAgent(t)
+	a.complete(d)
+
+	a.sendJSON(PausePublicationMessage, struct{}{})
+
+	//output after the pause is handled once the pause has been
+	a.sendOutput(Output, []byte("x"))
+	_, err := io.ReadFull(d, make([]byte, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := d.Write([]byte("input"))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		t.Fatalf("expected the write to block while publication is paused, returned %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	a.sendJSON(StartPublicationMessage, struct{}{})
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the write to complete once publication started")
+	}
+
+	m := a.readInput()
+	if string(m.Payload) != "input" {
+		t.Errorf("expected the input once publication started, got %q", m.Payload)
+	}
+}
+
+func TestClientMessageBinary(t *testing.T) {
+	m := &ClientMessage{
+		MessageType:    InputStreamMessage,
+		SchemaVersion:  1,
+		CreatedDate:    1700000000000,
+		SequenceNumber: 42,
+		Flags:          FlagData,
+		MessageId:      uuid.MustParse("00112233-4455-6677-8899-aabbccddeeff"),
+		PayloadType:    Output,
+		Payload:        []byte("payload"),
+	}
+
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimRight(string(b[messageTypeOffset:messageTypeOffset+messageTypeLength]), " "); got != InputStreamMessage {
+		t.Errorf("expected the padded message type, got %q", got)
+	}
+
+	//the least significant half of the message id is written first
+	if !bytes.Equal(b[messageIdOffset:messageIdOffset+8], m.MessageId[8:16]) || !bytes.Equal(b[messageIdOffset+8:messageIdOffset+16], m.MessageId[0:8]) {
+		t.Errorf("expected the message id halves to be swapped, got %x", b[messageIdOffset:messageIdOffset+16])
+	}
+
+	decoded := &ClientMessage{}
+	err = decoded.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.MessageType != m.MessageType || decoded.SchemaVersion != m.SchemaVersion || decoded.CreatedDate != m.CreatedDate ||
+		decoded.SequenceNumber != m.SequenceNumber || decoded.Flags != m.Flags || decoded.MessageId != m.MessageId ||
+		decoded.PayloadType != m.PayloadType || !bytes.Equal(decoded.Payload, m.Payload) {
+		t.Errorf("expected %+v after the round trip, got %+v", m, decoded)
+	}
+
+	b[len(b)-1] ^= 0xff
+	err = (&ClientMessage{}).UnmarshalBinary(b)
+	if err == nil {
+		t.Error("expected a payload digest mismatch for a modified payload")
+	}
+
+	err = (&ClientMessage{}).UnmarshalBinary(b[:payloadOffset-1])
+	if err == nil {
+		t.Error("expected an error for a truncated message")
+	}
+}
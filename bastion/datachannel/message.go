@@ -0,0 +1,157 @@
+package datachannel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// message types exchanged over the data channel
+const (
+	InputStreamMessage      = "input_stream_data"
+	OutputStreamMessage     = "output_stream_data"
+	AcknowledgeMessage      = "acknowledge"
+	ChannelClosedMessage    = "channel_closed"
+	StartPublicationMessage = "start_publication"
+	PausePublicationMessage = "pause_publication"
+)
+
+type PayloadType uint32
+
+const (
+	Output               PayloadType = 1
+	Error                PayloadType = 2
+	Size                 PayloadType = 3
+	Parameter            PayloadType = 4
+	HandshakeRequest     PayloadType = 5
+	HandshakeResponse    PayloadType = 6
+	HandshakeComplete    PayloadType = 7
+	EncChallengeRequest  PayloadType = 8
+	EncChallengeResponse PayloadType = 9
+	Flag                 PayloadType = 10
+	StdErr               PayloadType = 11
+	ExitCode             PayloadType = 12
+)
+
+// PayloadTypeFlag is the payload of a Flag message used by port sessions
+type PayloadTypeFlag uint32
+
+const (
+	DisconnectToPort   PayloadTypeFlag = 1
+	TerminateSession   PayloadTypeFlag = 2
+	ConnectToPortError PayloadTypeFlag = 3
+)
+
+// header flags
+const (
+	FlagData uint64 = 0
+	FlagSyn  uint64 = 1
+	FlagFin  uint64 = 2
+	FlagAck  uint64 = 3
+)
+
+// field offsets of the binary message, the header length excludes the
+// header length field itself and the payload length field
+const (
+	headerLengthOffset   = 0
+	messageTypeOffset    = 4
+	schemaVersionOffset  = 36
+	createdDateOffset    = 40
+	sequenceNumberOffset = 48
+	flagsOffset          = 56
+	messageIdOffset      = 64
+	payloadDigestOffset  = 80
+	payloadTypeOffset    = 112
+	payloadLengthOffset  = 116
+	payloadOffset        = 120
+
+	messageTypeLength = 32
+	headerLength      = payloadLengthOffset
+)
+
+// ClientMessage is a single message sent over the data channel websocket
+type ClientMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    uint64
+	SequenceNumber int64
+	Flags          uint64
+	MessageId      uuid.UUID
+	PayloadType    PayloadType
+	Payload        []byte
+}
+
+// MarshalBinary encodes the message as big endian with the message type padded with spaces
+func (m *ClientMessage) MarshalBinary() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, fmt.Errorf("message type %s is longer than %d bytes", m.MessageType, messageTypeLength)
+	}
+
+	b := make([]byte, payloadOffset+len(m.Payload))
+	digest := sha256.Sum256(m.Payload)
+
+	binary.BigEndian.PutUint32(b[headerLengthOffset:], headerLength)
+	copy(b[messageTypeOffset:], m.MessageType+strings.Repeat(" ", messageTypeLength-len(m.MessageType)))
+	binary.BigEndian.PutUint32(b[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(b[createdDateOffset:], m.CreatedDate)
+	binary.BigEndian.PutUint64(b[sequenceNumberOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(b[flagsOffset:], m.Flags)
+	putUUID(b[messageIdOffset:], m.MessageId)
+	copy(b[payloadDigestOffset:], digest[:])
+	binary.BigEndian.PutUint32(b[payloadTypeOffset:], uint32(m.PayloadType))
+	binary.BigEndian.PutUint32(b[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(b[payloadOffset:], m.Payload)
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes a message and validates the payload length and digest
+func (m *ClientMessage) UnmarshalBinary(b []byte) error {
+	if len(b) < payloadOffset {
+		return errors.New("message is shorter than the message header")
+	}
+
+	offset := int(binary.BigEndian.Uint32(b[headerLengthOffset:]))
+	if offset+4 > len(b) {
+		return errors.New("message header length is longer than the message")
+	}
+
+	payloadLength := int(binary.BigEndian.Uint32(b[offset:]))
+	if offset+4+payloadLength > len(b) {
+		return errors.New("message payload length is longer than the message")
+	}
+
+	m.MessageType = strings.TrimRight(string(b[messageTypeOffset:messageTypeOffset+messageTypeLength]), " \x00")
+	m.SchemaVersion = binary.BigEndian.Uint32(b[schemaVersionOffset:])
+	m.CreatedDate = binary.BigEndian.Uint64(b[createdDateOffset:])
+	m.SequenceNumber = int64(binary.BigEndian.Uint64(b[sequenceNumberOffset:]))
+	m.Flags = binary.BigEndian.Uint64(b[flagsOffset:])
+	m.MessageId = getUUID(b[messageIdOffset:])
+	m.PayloadType = PayloadType(binary.BigEndian.Uint32(b[payloadTypeOffset:]))
+	m.Payload = append([]byte(nil), b[offset+4:offset+4+payloadLength]...)
+
+	digest := sha256.Sum256(m.Payload)
+	if payloadLength > 0 && !bytes.Equal(digest[:], b[payloadDigestOffset:payloadDigestOffset+sha256.Size]) {
+		return fmt.Errorf("payload digest mismatch for message %s", m.MessageId)
+	}
+
+	return nil
+}
+
+// the message id is written with the least significant half first
+func putUUID(b []byte, id uuid.UUID) {
+	copy(b[0:8], id[8:16])
+	copy(b[8:16], id[0:8])
+}
+
+func getUUID(b []byte) uuid.UUID {
+	var id uuid.UUID
+	copy(id[8:16], b[0:8])
+	copy(id[0:8], b[8:16])
+	return id
+}
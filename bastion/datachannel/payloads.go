@@ -0,0 +1,72 @@
+package datachannel
+
+import "encoding/json"
+
+// openDataChannelInput is the first text frame sent after the websocket connects
+type openDataChannelInput struct {
+	MessageSchemaVersion string
+	RequestId            string
+	TokenValue           string
+	ClientId             string
+	ClientVersion        string
+}
+
+type acknowledgeContent struct {
+	MessageType         string `json:"AcknowledgedMessageType"`
+	MessageId           string `json:"AcknowledgedMessageId"`
+	SequenceNumber      int64  `json:"AcknowledgedMessageSequenceNumber"`
+	IsSequentialMessage bool   `json:"IsSequentialMessage"`
+}
+
+type channelClosed struct {
+	MessageId     string
+	CreatedDate   string
+	DestinationId string
+	SessionId     string
+	MessageType   string
+	SchemaVersion int
+	Output        string
+}
+
+type handshakeRequest struct {
+	AgentVersion           string
+	RequestedClientActions []requestedClientAction
+}
+
+type requestedClientAction struct {
+	ActionType       string
+	ActionParameters json.RawMessage
+}
+
+type handshakeResponse struct {
+	ClientVersion          string
+	ProcessedClientActions []processedClientAction
+	Errors                 []string
+}
+
+type processedClientAction struct {
+	ActionType   string
+	ActionStatus int
+	ActionResult json.RawMessage `json:",omitempty"`
+	Error        string          `json:",omitempty"`
+}
+
+type handshakeComplete struct {
+	HandshakeTimeToComplete int64
+	CustomerMessage         string
+}
+
+type sizeData struct {
+	Cols uint32 `json:"cols"`
+	Rows uint32 `json:"rows"`
+}
+
+// client action types and statuses used in the handshake
+const (
+	sessionTypeAction   = "SessionType"
+	kmsEncryptionAction = "KMSEncryption"
+
+	actionSuccess     = 1
+	actionFailed      = 2
+	actionUnsupported = 3
+)
@@ -1,7 +1,9 @@
 package bastion
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"log"
 	"time"
 
@@ -9,9 +11,13 @@ import (
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
-func StartEc2(id string, sess *session.Session, ami string, instanceProfile string, subnetId string, securitygroupId string, instanceType string, launchedBy string, userdata string, keyName string, spot bool, public bool, volumeSize int64, volumeEncryption bool, volumeType string) (string, error) {
+// ssmOnlineTimeout is how long to wait for the ssm agent of a new instance to register
+const ssmOnlineTimeout = 10 * time.Minute
+
+func StartEc2(id string, sess *session.Session, ami string, instanceProfile string, subnetId string, securitygroupId string, instanceType string, launchedBy string, userdata string, keyName string, spot bool, public bool, volumeSize int64, volumeEncryption bool, volumeType string, tags []*ec2.Tag) (string, error) {
 	client := ec2.New(sess)
 
 	input := &ec2.RunInstancesInput{
@@ -45,6 +51,8 @@ func StartEc2(id string, sess *session.Session, ami string, instanceProfile stri
 		},
 	}
 
+	input.TagSpecifications[0].Tags = append(input.TagSpecifications[0].Tags, tags...)
+
 	blockDeviceMapping := &ec2.BlockDeviceMapping{
 		DeviceName: aws.String("/dev/xvda"), // Using default mapping
 		Ebs: &ec2.EbsBlockDevice{
@@ -119,7 +127,7 @@ func TerminateEC2(sess *session.Session, instanceId string) error {
 	return nil
 }
 
-func WaitForBastionToRun(sess *session.Session, instanceId string) error {
+func WaitForBastionToRun(ctx aws.Context, sess *session.Session, instanceId string) error {
 	client := ec2.New(sess)
 	input := &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{
@@ -129,7 +137,7 @@ func WaitForBastionToRun(sess *session.Session, instanceId string) error {
 
 	log.Println("Waiting for bastion instance " + instanceId + " to reach a running state ...")
 
-	err := client.WaitUntilInstanceRunning(input)
+	err := client.WaitUntilInstanceRunningWithContext(ctx, input)
 	if err != nil {
 		return err
 	}
@@ -137,7 +145,7 @@ func WaitForBastionToRun(sess *session.Session, instanceId string) error {
 	return nil
 }
 
-func WaitForBastionStatusOK(sess *session.Session, instanceId string) error {
+func WaitForBastionStatusOK(ctx aws.Context, sess *session.Session, instanceId string) error {
 	client := ec2.New(sess)
 	input := &ec2.DescribeInstanceStatusInput{
 		InstanceIds: []*string{
@@ -147,7 +155,7 @@ func WaitForBastionStatusOK(sess *session.Session, instanceId string) error {
 
 	log.Println("Waiting for bastion instance " + instanceId + " to reach an ok status ...")
 
-	err := client.WaitUntilInstanceStatusOk(input)
+	err := client.WaitUntilInstanceStatusOkWithContext(ctx, input)
 	if err != nil {
 		return err
 	}
@@ -155,7 +163,58 @@ func WaitForBastionStatusOK(sess *session.Session, instanceId string) error {
 	return nil
 }
 
-func WaitForWindowsBastionPassword(sess *session.Session, instanceId string) error {
+// WaitForSSMOnline waits until the ssm agent on the instance reports it is online, sessions can't be started before then
+func WaitForSSMOnline(ctx aws.Context, sess *session.Session, instanceId string) error {
+	client := ssm.New(sess)
+	input := &ssm.DescribeInstanceInformationInput{
+		Filters: []*ssm.InstanceInformationStringFilter{
+			{
+				Key:    aws.String("InstanceIds"),
+				Values: []*string{aws.String(instanceId)},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ssmOnlineTimeout)
+	defer cancel()
+
+	logged := false
+	for {
+		resp, err := client.DescribeInstanceInformationWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		for _, inst := range resp.InstanceInformationList {
+			if aws.StringValue(inst.PingStatus) == ssm.PingStatusOnline {
+				return nil
+			}
+		}
+
+		if !logged {
+			log.Println("Waiting for the ssm agent on " + instanceId + " to come online ...")
+			logged = true
+		}
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("the ssm agent on %s didn't come online, %s", instanceId, ctx.Err())
+		}
+	}
+}
+
+// WaitForBastionReachable waits for the instance to run and for its ssm agent to come online so sessions can be started
+func WaitForBastionReachable(ctx aws.Context, sess *session.Session, instanceId string) error {
+	err := WaitForBastionToRun(ctx, sess, instanceId)
+	if err != nil {
+		return err
+	}
+
+	return WaitForSSMOnline(ctx, sess, instanceId)
+}
+
+func WaitForWindowsBastionPassword(ctx aws.Context, sess *session.Session, instanceId string) error {
 	client := ec2.New(sess)
 	input := &ec2.GetPasswordDataInput{
 		InstanceId: aws.String(instanceId),
@@ -164,7 +223,7 @@ func WaitForWindowsBastionPassword(sess *session.Session, instanceId string) err
 	log.Println("Waiting for bastion instance " + instanceId + " windows password to become available ...")
 
 	err := client.WaitUntilPasswordDataAvailableWithContext(
-		aws.BackgroundContext(),
+		ctx,
 		input,
 		request.WithWaiterMaxAttempts(30),
 		request.WithWaiterDelay(request.ConstantWaiterDelay(15*time.Second)))
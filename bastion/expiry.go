@@ -0,0 +1,288 @@
+package bastion
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go/v3"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/urfave/cli/v2"
+)
+
+func CmdExtendExpiry(c *cli.Context) error {
+	var (
+		instanceId string
+		expiresAt  string
+		commands   []string
+		err        error
+	)
+
+	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+
+	if c.String("instance-id") != "" {
+		instanceId = c.String("instance-id")
+	} else if c.String("session-id") != "" {
+		instanceId, err = GetInstanceIdBySessionId(sess, c.String("session-id"))
+		if err != nil {
+			return err
+		}
+	} else {
+		return errors.New("provide the bastion to extend with --session-id or --instance-id")
+	}
+
+	bastion, err := GetBastionInstance(sess, instanceId)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("cancel") {
+		expiresAt = "never"
+		commands = BuildCancelExpiryCommands(bastion.OS)
+	} else {
+		if c.Int("minutes") <= 0 {
+			return errors.New("minutes must be greater than 0")
+		}
+
+		expiry := GetExtendedExpiry(bastion.ExpiresAt, c.Int("minutes"), time.Now())
+		expiresAt = expiry.UTC().Format(time.RFC3339)
+
+		commands = append(BuildCancelExpiryCommands(bastion.OS), BuildExpiryCommands(bastion.OS, expiry)...)
+	}
+
+	log.Printf("Rescheduling the expiry of bastion %s ...", instanceId)
+
+	_, err = RunShellCommands(c.Context, sess, instanceId, bastion.OS, commands)
+	if err != nil {
+		return err
+	}
+
+	if expiresAt != "never" {
+		err = VerifyExpiry(c.Context, sess, instanceId, bastion.OS)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = SetExpiryTag(sess, instanceId, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	if expiresAt == "never" {
+		log.Printf("Expiry of bastion %s has been cancelled", instanceId)
+	} else {
+		log.Printf("Bastion %s will now expire at %s", instanceId, expiresAt)
+	}
+
+	return nil
+}
+
+// GetExtendedExpiry adds the minutes to the current expiry, or to now if the
+// bastion has no expiry or it has already passed
+func GetExtendedExpiry(expiresAt string, minutes int, now time.Time) time.Time {
+	base := now
+	current, err := time.Parse(time.RFC3339, expiresAt)
+	if err == nil && current.After(now) {
+		base = current
+	}
+
+	return base.Add(time.Duration(minutes) * time.Minute)
+}
+
+func BuildExpiryCommands(platform string, expiresAt time.Time) []string {
+	if platform == "windows" {
+		return BuildWindowsExpiryCommands(expiresAt)
+	}
+	return BuildLinuxExpiryCommands(expiresAt)
+}
+
+func BuildCancelExpiryCommands(platform string) []string {
+	if platform == "windows" {
+		return BuildWindowsCancelExpiryCommands()
+	}
+	return BuildLinuxCancelExpiryCommands()
+}
+
+func BuildExpiryCheckCommands(platform string) []string {
+	if platform == "windows" {
+		return BuildWindowsExpiryCheckCommands()
+	}
+	return BuildLinuxExpiryCheckCommands()
+}
+
+// BuildLinuxExpiryCommands arms a transient systemd timer that powers off the
+// instance at the expiry time, falling back to a scheduled shutdown on
+// distributions without systemd. The delay is calculated on the instance so the
+// expiry matches the bastion:expires-at tag regardless of how long boot takes
+func BuildLinuxExpiryCommands(expiresAt time.Time) []string {
+	return []string{
+		fmt.Sprintf("expiry_delay=$(( %d - $(date +%%s) ))", expiresAt.Unix()),
+		"if [ $expiry_delay -lt 1 ]; then expiry_delay=1; fi",
+		"if command -v systemd-run >/dev/null 2>&1; then",
+		"  systemd-run --unit=bastion-expiry --on-active=${expiry_delay}s /bin/sh -c 'shutdown -h now'",
+		"else",
+		"  shutdown -h +$(( (expiry_delay + 59) / 60 )) >/dev/null 2>&1 &",
+		"fi",
+	}
+}
+
+// BuildLinuxCancelExpiryCommands removes any armed expiry including at jobs
+// scheduled by older versions of bastion cli
+func BuildLinuxCancelExpiryCommands() []string {
+	return []string{
+		"systemctl stop bastion-expiry.timer >/dev/null 2>&1",
+		"systemctl reset-failed bastion-expiry.timer bastion-expiry.service >/dev/null 2>&1",
+		"shutdown -c >/dev/null 2>&1",
+		"for job in $(atq 2>/dev/null | cut -f1); do atrm $job; done",
+		"true",
+	}
+}
+
+// BuildLinuxExpiryCheckCommands waits for userdata to finish and prints armed if an expiry is scheduled
+func BuildLinuxExpiryCheckCommands() []string {
+	return []string{
+		"if command -v cloud-init >/dev/null 2>&1; then cloud-init status --wait >/dev/null 2>&1; fi",
+		"if systemctl is-active --quiet bastion-expiry.timer 2>/dev/null; then echo armed",
+		"elif [ -f /run/systemd/shutdown/scheduled ] || [ -n \"$(atq 2>/dev/null)\" ]; then echo armed",
+		"else echo disarmed; fi",
+	}
+}
+
+// BuildWindowsExpiryCommands registers a scheduled task that shuts down the
+// instance at the expiry time, the instance terminates on shutdown
+func BuildWindowsExpiryCommands(expiresAt time.Time) []string {
+	return []string{
+		fmt.Sprintf("$expiry = [DateTimeOffset]::FromUnixTimeSeconds(%d).LocalDateTime", expiresAt.Unix()),
+		"if ($expiry -lt (Get-Date)) { $expiry = (Get-Date).AddMinutes(1) }",
+		"$action = New-ScheduledTaskAction -Execute 'shutdown.exe' -Argument '/s /f /t 0'",
+		"$trigger = New-ScheduledTaskTrigger -Once -At $expiry",
+		"Register-ScheduledTask -TaskName 'BastionExpiry' -Action $action -Trigger $trigger -User 'SYSTEM' -RunLevel Highest -Force | Out-Null",
+	}
+}
+
+func BuildWindowsCancelExpiryCommands() []string {
+	return []string{
+		"Unregister-ScheduledTask -TaskName 'BastionExpiry' -Confirm:$false -ErrorAction SilentlyContinue",
+	}
+}
+
+// BuildWindowsExpiryCheckCommands waits up to 5 minutes for the userdata to register the expiry task
+func BuildWindowsExpiryCheckCommands() []string {
+	return []string{
+		"for ($i = 0; $i -lt 60; $i++) {",
+		"  if (Get-ScheduledTask -TaskName 'BastionExpiry' -ErrorAction SilentlyContinue) { Write-Output 'armed'; exit 0 }",
+		"  Start-Sleep -Seconds 5",
+		"}",
+		"Write-Output 'disarmed'",
+	}
+}
+
+// VerifyExpiry checks on the instance that the expiry has been armed
+func VerifyExpiry(ctx aws.Context, sess *session.Session, instanceId string, platform string) error {
+	output, err := RunShellCommands(ctx, sess, instanceId, platform, BuildExpiryCheckCommands(platform))
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(output) != "armed" {
+		return fmt.Errorf("expiry is not armed on bastion %s", instanceId)
+	}
+
+	return nil
+}
+
+func SetExpiryTag(sess *session.Session, instanceId string, expiresAt string) error {
+	client := ec2.New(sess)
+	input := &ec2.CreateTagsInput{
+		Resources: []*string{
+			aws.String(instanceId),
+		},
+		Tags: []*ec2.Tag{
+			{
+				Key:   aws.String("bastion:expires-at"),
+				Value: aws.String(expiresAt),
+			},
+		},
+	}
+
+	_, err := client.CreateTags(input)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RunShellCommands runs the commands on the instance using SSM Run Command and returns the output,
+// commands are run with PowerShell on windows instances
+func RunShellCommands(ctx aws.Context, sess *session.Session, instanceId string, platform string, commands []string) (string, error) {
+	client := ssm.New(sess)
+	var resp *ssm.SendCommandOutput
+
+	document := "AWS-RunShellScript"
+	if platform == "windows" {
+		document = "AWS-RunPowerShellScript"
+	}
+
+	input := &ssm.SendCommandInput{
+		DocumentName: aws.String(document),
+		InstanceIds: []*string{
+			aws.String(instanceId),
+		},
+		Parameters: map[string][]*string{
+			"commands": aws.StringSlice(commands),
+		},
+		Comment: aws.String("bastion cli"),
+	}
+
+	// a newly launched instance is rejected until the ssm agent has registered
+	err := retry.Do(
+		func() error {
+			out, err := client.SendCommandWithContext(ctx, input)
+			resp = out
+			return err
+		},
+		retry.Context(ctx),
+		retry.Delay(5*time.Second),
+		retry.DelayType(retry.FixedDelay),
+		retry.Attempts(36),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(func(err error) bool {
+			if aerr, ok := err.(awserr.Error); ok {
+				return aerr.Code() == ssm.ErrCodeInvalidInstanceId
+			}
+			return false
+		}),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	invocationInput := &ssm.GetCommandInvocationInput{
+		CommandId:  resp.Command.CommandId,
+		InstanceId: aws.String(instanceId),
+	}
+
+	// allow up to 5 minutes for long running userdata to complete
+	waitErr := client.WaitUntilCommandExecutedWithContext(ctx, invocationInput, request.WithWaiterMaxAttempts(60))
+
+	invocation, err := client.GetCommandInvocationWithContext(ctx, invocationInput)
+	if err != nil {
+		return "", err
+	}
+
+	if waitErr != nil {
+		return "", fmt.Errorf("command %s on %s finished with status %s, %s",
+			*resp.Command.CommandId, instanceId, aws.StringValue(invocation.Status), aws.StringValue(invocation.StandardErrorContent))
+	}
+
+	return aws.StringValue(invocation.StandardOutputContent), nil
+}
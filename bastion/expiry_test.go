@@ -0,0 +1,30 @@
+package bastion
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetExtendedExpiry(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		expiresAt string
+		minutes   int
+		expected  time.Time
+	}{
+		{name: "future expiry", expiresAt: "2021-06-01T13:00:00Z", minutes: 60, expected: now.Add(2 * time.Hour)},
+		{name: "passed expiry", expiresAt: "2021-06-01T11:00:00Z", minutes: 30, expected: now.Add(30 * time.Minute)},
+		{name: "never expires", expiresAt: "never", minutes: 60, expected: now.Add(time.Hour)},
+		{name: "no expiry tag", expiresAt: "", minutes: 15, expected: now.Add(15 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetExtendedExpiry(tt.expiresAt, tt.minutes, now); !got.Equal(tt.expected) {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package bastion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/base2Services/bastion-cli/bastion/datachannel"
+)
+
+// portForward maps a local port to a port on a remote host reachable from the
+// bastion, an empty remote host forwards to a port on the bastion itself
+type portForward struct {
+	LocalPort  string `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort string `json:"remote_port"`
+}
+
+func (f portForward) String() string {
+	host := f.RemoteHost
+	if host == "" {
+		host = "bastion"
+	}
+	return fmt.Sprintf("localhost:%s -> %s:%s", f.LocalPort, host, f.RemotePort)
+}
+
+// StartSessionInput builds the port forwarding session for the mapping through the bastion
+func (f portForward) StartSessionInput(instanceId string) *ssm.StartSessionInput {
+	input := &ssm.StartSessionInput{
+		DocumentName: aws.String("AWS-StartPortForwardingSession"),
+		Parameters: map[string][]*string{
+			"portNumber":      {aws.String(f.RemotePort)},
+			"localPortNumber": {aws.String(f.LocalPort)},
+		},
+		Target: aws.String(instanceId),
+	}
+
+	if f.RemoteHost != "" {
+		input.DocumentName = aws.String("AWS-StartPortForwardingSessionToRemoteHost")
+		input.Parameters["host"] = []*string{aws.String(f.RemoteHost)}
+	}
+
+	return input
+}
+
+// ParsePortForward parses a mapping in the form local:host:remote
+func ParsePortForward(value string) (portForward, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 3 {
+		return portForward{}, fmt.Errorf("invalid forward %s, expected local-port:host:remote-port", value)
+	}
+
+	forward := portForward{
+		LocalPort:  parts[0],
+		RemoteHost: strings.Join(parts[1:len(parts)-1], ":"),
+		RemotePort: parts[len(parts)-1],
+	}
+
+	for _, port := range []string{forward.LocalPort, forward.RemotePort} {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return portForward{}, fmt.Errorf("invalid forward %s, %s is not a valid port", value, port)
+		}
+	}
+
+	if forward.RemoteHost == "" {
+		return portForward{}, fmt.Errorf("invalid forward %s, the host is required", value)
+	}
+
+	return forward, nil
+}
+
+func ParsePortForwards(values []string) ([]portForward, error) {
+	var forwards []portForward
+	for _, value := range values {
+		forward, err := ParsePortForward(value)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, forward)
+	}
+	return forwards, nil
+}
+
+// forwardEvent is reported when a forwarded connection is opened or closed,
+// the byte counts are only set when the connection closes
+type forwardEvent struct {
+	Type     string
+	Forward  portForward
+	Client   string
+	Sent     int64
+	Received int64
+	Err      error
+}
+
+type forwardStats struct {
+	Connections int
+	Sent        int64
+	Received    int64
+}
+
+// sessionStartInterval paces the sessions started for new connections, StartSession is
+// throttled at a few requests a second and every connection starts its own session
+const sessionStartInterval = time.Second / 3
+
+// keepAliveRetryInterval is how long to wait before reopening the keep alive session
+const keepAliveRetryInterval = 30 * time.Second
+
+// portForwarder listens on the local port of each mapping and forwards every
+// connection through its own port forwarding session on the bastion. The built in
+// client doesn't multiplex connections over a single session like the plugin does
+type portForwarder struct {
+	sess       *session.Session
+	instanceId string
+	forwards   []portForward
+	listeners  []net.Listener
+
+	// OnEvent is called for each connection event, defaults to logging the event
+	OnEvent func(forwardEvent)
+
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	conns     map[net.Conn]bool
+	stats     []forwardStats
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	startMu   sync.Mutex
+	lastStart time.Time
+}
+
+func NewPortForwarder(sess *session.Session, instanceId string, forwards []portForward) *portForwarder {
+	return &portForwarder{
+		sess:       sess,
+		instanceId: instanceId,
+		forwards:   forwards,
+		OnEvent:    LogForwardEvent,
+		conns:      map[net.Conn]bool{},
+		stats:      make([]forwardStats, len(forwards)),
+		closing:    make(chan struct{}),
+	}
+}
+
+// Start binds the local port of every mapping, the tunnels are ready to accept connections once it returns
+func (f *portForwarder) Start() error {
+	for _, forward := range f.forwards {
+		listener, err := net.Listen("tcp", net.JoinHostPort("localhost", forward.LocalPort))
+		if err != nil {
+			f.closeListeners()
+			return fmt.Errorf("unable to listen on local port %s, %s", forward.LocalPort, err)
+		}
+		f.listeners = append(f.listeners, listener)
+	}
+
+	for i, listener := range f.listeners {
+		f.wg.Add(1)
+		go f.serve(i, listener)
+		log.Printf("Forwarding %s through %s", f.forwards[i], f.instanceId)
+	}
+
+	//There is no session between connections so the idle watchdog would halt the bastion
+	instance, err := GetBastionInstance(f.sess, f.instanceId)
+	if err != nil {
+		log.Printf("unable to check the idle timeout of %s, %s", f.instanceId, err)
+	} else if instance.IdleTimeout != "" && instance.IdleTimeout != "disabled" {
+		f.wg.Add(1)
+		go f.keepAlive()
+	}
+
+	return nil
+}
+
+// Close stops listening, closes every open connection and waits for their sessions to be terminated
+func (f *portForwarder) Close() {
+	f.closeOnce.Do(func() { close(f.closing) })
+	f.closeListeners()
+
+	f.mu.Lock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+
+	for i, forward := range f.forwards {
+		stats := f.Stats(i)
+		log.Printf("Closed %s, %d connections, %d bytes sent, %d bytes received",
+			forward, stats.Connections, stats.Sent, stats.Received)
+	}
+}
+
+// Stats returns the connection count and bytes transferred for the mapping
+func (f *portForwarder) Stats(i int) forwardStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats[i]
+}
+
+func (f *portForwarder) closeListeners() {
+	for _, listener := range f.listeners {
+		listener.Close()
+	}
+}
+
+func (f *portForwarder) serve(i int, listener net.Listener) {
+	defer f.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("stopped accepting connections for %s, %s", f.forwards[i], err)
+			}
+			return
+		}
+
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.stats[i].Connections++
+		f.mu.Unlock()
+
+		f.wg.Add(1)
+		go f.forward(i, conn)
+	}
+}
+
+func (f *portForwarder) forward(i int, conn net.Conn) {
+	defer f.wg.Done()
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+	}()
+
+	forward := f.forwards[i]
+	event := forwardEvent{Forward: forward, Client: conn.RemoteAddr().String()}
+
+	var (
+		dc      *datachannel.DataChannel
+		session *ssm.StartSessionOutput
+	)
+
+	err := f.waitSessionStart()
+	if err == nil {
+		dc, session, err = OpenSessionStream(f.sess, forward.StartSessionInput(f.instanceId))
+	}
+	if err != nil {
+		event.Type = "close"
+		event.Err = err
+		f.OnEvent(event)
+		return
+	}
+
+	event.Type = "open"
+	f.OnEvent(event)
+
+	sent := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(dc, conn)
+		dc.SendFlag(datachannel.DisconnectToPort)
+		dc.Close()
+		sent <- n
+	}()
+
+	received, _ := io.Copy(conn, dc)
+	conn.Close()
+
+	event.Type = "close"
+	event.Sent = <-sent
+	event.Received = received
+	event.Err = dc.Err()
+
+	err = TerminateSession(f.sess, *session.SessionId)
+	if err != nil {
+		log.Println(err)
+	}
+
+	f.mu.Lock()
+	f.stats[i].Sent += event.Sent
+	f.stats[i].Received += event.Received
+	f.mu.Unlock()
+
+	f.OnEvent(event)
+}
+
+// waitSessionStart queues the connection until a session can be started without being throttled
+func (f *portForwarder) waitSessionStart() error {
+	f.startMu.Lock()
+	defer f.startMu.Unlock()
+
+	wait := time.Until(f.lastStart.Add(sessionStartInterval))
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-f.closing:
+			return errors.New("the port forward is closing")
+		}
+	}
+
+	f.lastStart = time.Now()
+	return nil
+}
+
+// keepAlive holds a shell session open while the forwarder runs so the idle watchdog doesn't
+// halt the bastion between connections, the session is reopened whenever it is closed
+func (f *portForwarder) keepAlive() {
+	defer f.wg.Done()
+
+	for {
+		err := f.waitSessionStart()
+		if err != nil {
+			return
+		}
+
+		dc, session, err := OpenSessionStream(f.sess, &ssm.StartSessionInput{Target: aws.String(f.instanceId)})
+		if err != nil {
+			log.Printf("unable to start the keep alive session, %s", err)
+		} else {
+			go io.Copy(ioutil.Discard, dc)
+
+			select {
+			case <-dc.Done():
+			case <-f.closing:
+			}
+
+			dc.Close()
+			err = TerminateSession(f.sess, *session.SessionId)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		select {
+		case <-time.After(keepAliveRetryInterval):
+		case <-f.closing:
+			return
+		}
+	}
+}
+
+func LogForwardEvent(event forwardEvent) {
+	switch {
+	case event.Type == "open":
+		log.Printf("connection from %s opened to %s", event.Client, event.Forward)
+	case event.Err != nil:
+		log.Printf("connection from %s to %s closed, %d bytes sent, %d bytes received, %s",
+			event.Client, event.Forward, event.Sent, event.Received, event.Err)
+	default:
+		log.Printf("connection from %s to %s closed, %d bytes sent, %d bytes received",
+			event.Client, event.Forward, event.Sent, event.Received)
+	}
+}
+
+// ForwardPorts forwards every mapping through the bastion until the context is
+// cancelled or the command is interrupted
+func ForwardPorts(ctx context.Context, sess *session.Session, instanceId string, forwards []portForward) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	//Connections can't be forwarded until sessions can be started on the bastion
+	err := WaitForBastionReachable(ctx, sess, instanceId)
+	if err != nil {
+		return err
+	}
+
+	forwarder := NewPortForwarder(sess, instanceId, forwards)
+	err = forwarder.Start()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Port forwarding is ready, press ctrl-c to stop")
+	<-ctx.Done()
+
+	forwarder.Close()
+	return nil
+}
+
+// RunWithPortForwards starts forwarding every mapping, runs the command once the bastion can start sessions
+// and the local ports are accepting connections and returns the exit code of the command. The first mapping is
+// passed to the command with the BASTION_TUNNEL_LOCAL_PORT, BASTION_TUNNEL_REMOTE_HOST and BASTION_TUNNEL_REMOTE_PORT variables
+func RunWithPortForwards(ctx context.Context, sess *session.Session, instanceId string, forwards []portForward, command []string) (int, error) {
+	err := WaitForBastionReachable(ctx, sess, instanceId)
+	if err != nil {
+		return 0, err
+	}
+
+	forwarder := NewPortForwarder(sess, instanceId, forwards)
+	err = forwarder.Start()
+	if err != nil {
+		return 0, err
+	}
+	defer forwarder.Close()
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"BASTION_TUNNEL_LOCAL_PORT="+forwards[0].LocalPort,
+		"BASTION_TUNNEL_REMOTE_HOST="+forwards[0].RemoteHost,
+		"BASTION_TUNNEL_REMOTE_PORT="+forwards[0].RemotePort,
+	)
+
+	log.Printf("Running %s", strings.Join(command, " "))
+
+	err = RunCommand(cmd)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,42 @@
+package bastion
+
+import (
+	"testing"
+)
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected portForward
+		err      bool
+	}{
+		{value: "5432:db.internal:5432", expected: portForward{LocalPort: "5432", RemoteHost: "db.internal", RemotePort: "5432"}},
+		{value: "8080:10.0.0.1:80", expected: portForward{LocalPort: "8080", RemoteHost: "10.0.0.1", RemotePort: "80"}},
+		{value: "6000:fd00::1:443", expected: portForward{LocalPort: "6000", RemoteHost: "fd00::1", RemotePort: "443"}},
+		{value: "5432:db.internal", err: true},
+		{value: "5432", err: true},
+		{value: "5432::5432", err: true},
+		{value: "local:db.internal:5432", err: true},
+		{value: "5432:db.internal:remote", err: true},
+		{value: "0:db.internal:5432", err: true},
+		{value: "5432:db.internal:65536", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			forward, err := ParsePortForward(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", forward)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if forward != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, forward)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package bastion
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/urfave/cli/v2"
+)
+
+// instance states in which a bastion still owns its resources
+var activeBastionStates = []string{"pending", "running", "stopping", "stopped"}
+
+// orphanMinimumAge covers a launch in progress, which creates its security group and can add
+// rules before its instance exists
+const orphanMinimumAge = 15 * time.Minute
+
+type orphanedResource struct {
+	Type      string
+	Id        string
+	SessionId string
+	GroupId   string
+	Port      int64
+}
+
+func CmdGarbageCollect(c *cli.Context) error {
+	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+
+	orphans, err := FindOrphanedResources(sess)
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) == 0 {
+		log.Println("no orphaned bastion resources found")
+		return nil
+	}
+
+	err = PrintOrphanedResources(orphans)
+	if err != nil {
+		return err
+	}
+
+	if !c.Bool("apply") {
+		log.Println("run again with --apply to delete the orphaned resources")
+		return nil
+	}
+
+	failed := 0
+	for _, orphan := range orphans {
+		err = DeleteOrphanedResource(sess, orphan)
+		if err != nil {
+			log.Printf("failed to delete %s %s, %s", orphan.Type, orphan.Id, err)
+			failed++
+			continue
+		}
+		log.Printf("deleted %s %s", orphan.Type, orphan.Id)
+	}
+
+	//Clear journal entries for rules that were already removed outside of bastion
+	err = RevokeStaleSecurityGroupRules(sess, c.String("region"), c.String("profile"))
+	if err != nil {
+		log.Printf("failed to revoke journalled security group rules, %s", err)
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d orphaned resources", failed)
+	}
+
+	return nil
+}
+
+func FindOrphanedResources(sess *session.Session) ([]orphanedResource, error) {
+	var orphans []orphanedResource
+
+	bastions, err := GetBastionInstances(sess, activeBastionStates, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := map[string]bool{}
+	groups := map[string]bool{}
+	for _, b := range bastions {
+		sessions[b.SessionId] = true
+		for _, group := range b.SecurityGroupIds {
+			groups[group] = true
+		}
+	}
+
+	live, err := GetLiveSessions(sess, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for sessionId := range live {
+		sessions[sessionId] = true
+	}
+
+	keyPairs, err := FindOrphanedKeyPairs(sess, sessions)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, keyPairs...)
+
+	parameters, err := FindOrphanedKeyPairParameters(sess, sessions)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, parameters...)
+
+	rules, err := FindOrphanedSecurityGroupRules(sess, sessions, groups)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, rules...)
+
+	//Security groups are deleted after the rules that reference them have been revoked
+	securityGroups, err := FindOrphanedSecurityGroups(sess, sessions)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, securityGroups...)
+
+	return orphans, nil
+}
+
+// GetLiveSessions returns the sessions that may not have an instance yet, those with a security group or a
+// journalled rule created within orphanMinimumAge, and the sessions of running tunnels
+func GetLiveSessions(sess *session.Session, now time.Time) (map[string]bool, error) {
+	client := ec2.New(sess)
+	sessions := map[string]bool{}
+
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("bastion:created-at")},
+			},
+		},
+	}
+
+	err := client.DescribeSecurityGroupsPages(input,
+		func(page *ec2.DescribeSecurityGroupsOutput, lastPage bool) bool {
+			for _, group := range page.SecurityGroups {
+				createdAt, err := time.Parse(time.RFC3339, GetTagValue(group.Tags, "bastion:created-at"))
+				if err == nil && IsRecentlyCreated(createdAt, now) {
+					sessions[GetTagValue(group.Tags, "bastion:session-id")] = true
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := GetJournalEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if IsRecentlyCreated(entry.CreatedAt, now) {
+			sessions[entry.Rule.SessionId] = true
+		}
+	}
+
+	states, err := GetTunnelStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		if state.SessionId != "" && IsProcessRunning(state.Pid) {
+			sessions[state.SessionId] = true
+		}
+	}
+
+	return sessions, nil
+}
+
+// IsRecentlyCreated is true for resources younger than orphanMinimumAge, they may belong to a launch in progress
+func IsRecentlyCreated(createdAt time.Time, now time.Time) bool {
+	return now.Sub(createdAt) < orphanMinimumAge
+}
+
+func FindOrphanedKeyPairs(sess *session.Session, sessions map[string]bool) ([]orphanedResource, error) {
+	client := ec2.New(sess)
+	var orphans []orphanedResource
+
+	input := &ec2.DescribeKeyPairsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("key-name"),
+				Values: []*string{
+					aws.String(GetKeyPairName("*")),
+				},
+			},
+		},
+	}
+
+	resp, err := client.DescribeKeyPairs(input)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range resp.KeyPairs {
+		sessionId := strings.TrimPrefix(aws.StringValue(key.KeyName), GetKeyPairName(""))
+		if !sessions[sessionId] {
+			orphans = append(orphans, orphanedResource{
+				Type:      "key-pair",
+				Id:        aws.StringValue(key.KeyName),
+				SessionId: sessionId,
+			})
+		}
+	}
+
+	return orphans, nil
+}
+
+func FindOrphanedKeyPairParameters(sess *session.Session, sessions map[string]bool) ([]orphanedResource, error) {
+	client := ssm.New(sess)
+	var orphans []orphanedResource
+
+	input := &ssm.DescribeParametersInput{
+		ParameterFilters: []*ssm.ParameterStringFilter{
+			{
+				Key:    aws.String("Name"),
+				Option: aws.String("BeginsWith"),
+				Values: []*string{
+					aws.String(GetDefaultKeyPairParameterName("")),
+				},
+			},
+		},
+	}
+
+	err := client.DescribeParametersPages(input,
+		func(page *ssm.DescribeParametersOutput, lastPage bool) bool {
+			for _, parameter := range page.Parameters {
+				sessionId := strings.TrimPrefix(aws.StringValue(parameter.Name), GetDefaultKeyPairParameterName(""))
+				if !sessions[sessionId] {
+					orphans = append(orphans, orphanedResource{
+						Type:      "ssm-parameter",
+						Id:        aws.StringValue(parameter.Name),
+						SessionId: sessionId,
+					})
+				}
+			}
+			return true
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
+
+// FindOrphanedSecurityGroupRules finds the rules added by bastion whose session no longer exists, rules
+// added before the description was tagged with the session id are matched on the bastion security group
+func FindOrphanedSecurityGroupRules(sess *session.Session, sessions map[string]bool, groups map[string]bool) ([]orphanedResource, error) {
+	client := ec2.New(sess)
+	var orphans []orphanedResource
+
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("ip-permission.protocol"),
+				Values: []*string{
+					aws.String("tcp"),
+				},
+			},
+		},
+	}
+
+	err := client.DescribeSecurityGroupsPages(input,
+		func(page *ec2.DescribeSecurityGroupsOutput, lastPage bool) bool {
+			for _, group := range page.SecurityGroups {
+				for _, permission := range group.IpPermissions {
+					for _, pair := range permission.UserIdGroupPairs {
+						sessionId, ok := GetSessionIdFromRuleDescription(aws.StringValue(pair.Description))
+						if !ok || (sessionId != "" && sessions[sessionId]) || (sessionId == "" && groups[aws.StringValue(pair.GroupId)]) {
+							continue
+						}
+						orphans = append(orphans, orphanedResource{
+							Type:      "security-group-rule",
+							Id:        aws.StringValue(group.GroupId),
+							SessionId: sessionId,
+							GroupId:   aws.StringValue(pair.GroupId),
+							Port:      aws.Int64Value(permission.FromPort),
+						})
+					}
+				}
+			}
+			return true
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	//Rules added through an existing instance are tagged with its instance id
+	var instanceIds []string
+	for _, orphan := range orphans {
+		if strings.HasPrefix(orphan.SessionId, "i-") {
+			instanceIds = append(instanceIds, orphan.SessionId)
+		}
+	}
+
+	instances, err := GetActiveInstanceIds(sess, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var inactive []orphanedResource
+	for _, orphan := range orphans {
+		if !instances[orphan.SessionId] {
+			inactive = append(inactive, orphan)
+		}
+	}
+
+	return inactive, nil
+}
+
+// FindOrphanedSecurityGroups finds the security groups created for bastion sessions that no longer exist
+func FindOrphanedSecurityGroups(sess *session.Session, sessions map[string]bool) ([]orphanedResource, error) {
+	client := ec2.New(sess)
+	var orphans []orphanedResource
+
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("tag-key"),
+				Values: []*string{
+					aws.String("bastion:session-id"),
+				},
+			},
+		},
+	}
+
+	err := client.DescribeSecurityGroupsPages(input,
+		func(page *ec2.DescribeSecurityGroupsOutput, lastPage bool) bool {
+			for _, group := range page.SecurityGroups {
+				sessionId := GetTagValue(group.Tags, "bastion:session-id")
+				if !sessions[sessionId] {
+					orphans = append(orphans, orphanedResource{
+						Type:      "security-group",
+						Id:        aws.StringValue(group.GroupId),
+						SessionId: sessionId,
+					})
+				}
+			}
+			return true
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
+
+func DeleteOrphanedResource(sess *session.Session, orphan orphanedResource) error {
+	switch orphan.Type {
+	case "key-pair":
+		return DeleteKeyPair(sess, orphan.SessionId)
+	case "ssm-parameter":
+		return DeleteKeyPairParameter(sess, orphan.Id)
+	case "security-group-rule":
+		err := RevertSecurityGroup(sess, orphan.Id, orphan.GroupId, orphan.Port)
+		if err != nil {
+			return err
+		}
+		return RemoveJournalEntries(securityGroupRule{GroupId: orphan.Id, SourceGroupId: orphan.GroupId, Port: orphan.Port, SessionId: orphan.SessionId})
+	case "security-group":
+		return DeleteSecurityGroup(sess, orphan.Id)
+	default:
+		return fmt.Errorf("unknown resource type %s", orphan.Type)
+	}
+}
+
+func PrintOrphanedResources(orphans []orphanedResource) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tRESOURCE\tDETAIL")
+
+	for _, orphan := range orphans {
+		detail := fmt.Sprintf("session %s", orphan.SessionId)
+		if orphan.Type == "security-group-rule" {
+			detail = fmt.Sprintf("tcp/%d from %s", orphan.Port, orphan.GroupId)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", orphan.Type, orphan.Id, detail)
+	}
+
+	return w.Flush()
+}
@@ -4,11 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/urfave/cli/v2"
 )
 
 type PolicyDocument struct {
@@ -110,16 +115,19 @@ func IAMInstanceProfileExists(sess *session.Session) (bool, error) {
 	return true, nil
 }
 
-func CreateIAMPolicy(sess *session.Session) (string, error) {
-	client := iam.New(sess)
-
-	policy := PolicyDocument{
+func BuildIAMPolicyDocument() PolicyDocument {
+	return PolicyDocument{
 		Version: "2012-10-17",
 		Statement: []PolicyStatementEntry{
 			{
 				Effect: "Allow",
 				Action: []string{
+					"ec2messages:AcknowledgeMessage",
+					"ec2messages:DeleteMessage",
+					"ec2messages:FailMessage",
+					"ec2messages:GetEndpoint",
 					"ec2messages:GetMessages",
+					"ec2messages:SendReply",
 					"ssm:ListAssociations",
 					"ssm:ListInstanceAssociations",
 					"ssm:UpdateInstanceInformation",
@@ -132,6 +140,12 @@ func CreateIAMPolicy(sess *session.Session) (string, error) {
 			},
 		},
 	}
+}
+
+func CreateIAMPolicy(sess *session.Session) (string, error) {
+	client := iam.New(sess)
+
+	policy := BuildIAMPolicyDocument()
 
 	policyBytes, err := json.Marshal(&policy)
 	if err != nil {
@@ -154,6 +168,145 @@ func CreateIAMPolicy(sess *session.Session) (string, error) {
 	return policyArn, nil
 }
 
+func GetIAMPolicyArn(sess *session.Session) (string, error) {
+	client := sts.New(sess)
+	callerId, err := client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+
+	callerArn, err := arn.Parse(*callerId.Arn)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("arn:%s:iam::%s:policy/%s", callerArn.Partition, *callerId.Account, profileName), nil
+}
+
+// CmdUpdateIAMPolicy adds the actions required by newer features to a bastion IAM policy created by an older
+// version, it is only run on request as it replaces the default version of a policy shared by the account
+func CmdUpdateIAMPolicy(c *cli.Context) error {
+	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+
+	policyArn, missing, err := GetMissingIAMPolicyActions(sess)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) == 0 {
+		log.Printf("IAM policy %s is up to date", policyArn)
+		return nil
+	}
+
+	log.Printf("Adding %s to IAM policy %s ...", strings.Join(missing, ", "), policyArn)
+
+	err = UpdateIAMPolicy(sess, policyArn)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("IAM policy %s updated", policyArn)
+	return nil
+}
+
+// GetMissingIAMPolicyActions returns the actions of the current policy document that
+// are missing from the default version of the bastion IAM policy
+func GetMissingIAMPolicyActions(sess *session.Session) (string, []string, error) {
+	client := iam.New(sess)
+
+	policyArn, err := GetIAMPolicyArn(sess)
+	if err != nil {
+		return "", nil, err
+	}
+
+	policy, err := client.GetPolicy(&iam.GetPolicyInput{PolicyArn: aws.String(policyArn)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return "", nil, fmt.Errorf("IAM policy %s doesn't exist, it is created by the next launch", policyArn)
+		}
+		return "", nil, err
+	}
+
+	version, err := client.GetPolicyVersion(&iam.GetPolicyVersionInput{
+		PolicyArn: aws.String(policyArn),
+		VersionId: policy.Policy.DefaultVersionId,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	document, err := url.QueryUnescape(*version.PolicyVersion.Document)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var current PolicyDocument
+	err = json.Unmarshal([]byte(document), &current)
+	if err != nil {
+		return "", nil, err
+	}
+
+	actions := map[string]bool{}
+	for _, statement := range current.Statement {
+		for _, action := range statement.Action {
+			actions[action] = true
+		}
+	}
+
+	var missing []string
+	for _, action := range BuildIAMPolicyDocument().Statement[0].Action {
+		if !actions[action] {
+			missing = append(missing, action)
+		}
+	}
+
+	return policyArn, missing, nil
+}
+
+// UpdateIAMPolicy adds the current policy document as the default version of the bastion IAM policy
+func UpdateIAMPolicy(sess *session.Session, policyArn string) error {
+	client := iam.New(sess)
+
+	// a policy can only have 5 versions so remove the oldest non default version
+	versions, err := client.ListPolicyVersions(&iam.ListPolicyVersionsInput{PolicyArn: aws.String(policyArn)})
+	if err != nil {
+		return err
+	}
+
+	if len(versions.Versions) >= 5 {
+		var oldest *iam.PolicyVersion
+		for _, v := range versions.Versions {
+			if !*v.IsDefaultVersion && (oldest == nil || v.CreateDate.Before(*oldest.CreateDate)) {
+				oldest = v
+			}
+		}
+
+		log.Printf("Deleting version %s of IAM policy %s as a policy can only have 5 versions", aws.StringValue(oldest.VersionId), policyArn)
+
+		_, err = client.DeletePolicyVersion(&iam.DeletePolicyVersionInput{
+			PolicyArn: aws.String(policyArn),
+			VersionId: oldest.VersionId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	desired := BuildIAMPolicyDocument()
+	desiredBytes, err := json.Marshal(&desired)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CreatePolicyVersion(&iam.CreatePolicyVersionInput{
+		PolicyArn:      aws.String(policyArn),
+		PolicyDocument: aws.String(string(desiredBytes)),
+		SetAsDefault:   aws.Bool(true),
+	})
+
+	return err
+}
+
 func CreateIAMRole(sess *session.Session) error {
 	client := iam.New(sess)
 
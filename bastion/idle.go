@@ -0,0 +1,75 @@
+package bastion
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ValidateIdleTimeout allows 0 to disable the watchdog, it checks for sessions every minute
+func ValidateIdleTimeout(idleTimeout time.Duration) error {
+	if idleTimeout != 0 && idleTimeout < time.Minute {
+		return errors.New("idle-timeout must be at least 1m")
+	}
+	return nil
+}
+
+func BuildIdleTimeoutTag(idleTimeout time.Duration) *ec2.Tag {
+	value := "disabled"
+	if idleTimeout > 0 {
+		value = idleTimeout.String()
+	}
+
+	return &ec2.Tag{
+		Key:   aws.String("bastion:idle-timeout"),
+		Value: aws.String(value),
+	}
+}
+
+// BuildLinuxIdleWatchdogCommands installs a script that runs every minute and
+// shuts down the instance once there has been no Session Manager or SSH
+// session for the idle timeout. The idle window starts when the instance boots
+func BuildLinuxIdleWatchdogCommands(idleTimeout time.Duration) []string {
+	return []string{
+		"cat > /usr/local/bin/bastion-idle-watchdog <<'EOF'",
+		"#!/bin/sh",
+		"state=/run/bastion-last-active",
+		"if pgrep -f ssm-session-worker >/dev/null 2>&1 || pgrep -f 'sshd: .*@' >/dev/null 2>&1; then",
+		"  date +%s > $state",
+		"  exit 0",
+		"fi",
+		"[ -f $state ] || date +%s > $state",
+		fmt.Sprintf("if [ $(( $(date +%%s) - $(cat $state) )) -ge %d ]; then", int(idleTimeout.Seconds())),
+		"  shutdown -h now",
+		"fi",
+		"EOF",
+		"chmod 755 /usr/local/bin/bastion-idle-watchdog",
+		"date +%s > /run/bastion-last-active",
+		"if command -v systemd-run >/dev/null 2>&1; then",
+		"  systemd-run --unit=bastion-idle --on-active=60s --on-unit-active=60s /usr/local/bin/bastion-idle-watchdog",
+		"else",
+		"  nohup sh -c 'while true; do sleep 60; /usr/local/bin/bastion-idle-watchdog; done' >/dev/null 2>&1 &",
+		"fi",
+	}
+}
+
+// BuildWindowsIdleWatchdogCommands registers a scheduled task that runs every minute and
+// shuts down the instance once there has been no Session Manager session for the idle timeout
+func BuildWindowsIdleWatchdogCommands(idleTimeout time.Duration) []string {
+	return []string{
+		"New-Item -ItemType Directory -Force -Path 'C:\\ProgramData\\Bastion' | Out-Null",
+		"@'",
+		"$state = 'C:\\ProgramData\\Bastion\\last-active'",
+		"if (Get-Process -Name ssm-session-worker -ErrorAction SilentlyContinue) { Set-Content -Path $state -Value ''; exit }",
+		"if (-not (Test-Path $state)) { Set-Content -Path $state -Value '' }",
+		fmt.Sprintf("if (((Get-Date) - (Get-Item $state).LastWriteTime).TotalSeconds -ge %d) { shutdown.exe /s /f /t 0 }", int(idleTimeout.Seconds())),
+		"'@ | Set-Content -Path 'C:\\ProgramData\\Bastion\\idle-watchdog.ps1'",
+		"Set-Content -Path 'C:\\ProgramData\\Bastion\\last-active' -Value ''",
+		"$action = New-ScheduledTaskAction -Execute 'powershell.exe' -Argument '-NoProfile -ExecutionPolicy Bypass -File C:\\ProgramData\\Bastion\\idle-watchdog.ps1'",
+		"$trigger = New-ScheduledTaskTrigger -Once -At (Get-Date).AddMinutes(1) -RepetitionInterval (New-TimeSpan -Minutes 1)",
+		"Register-ScheduledTask -TaskName 'BastionIdleWatchdog' -Action $action -Trigger $trigger -User 'SYSTEM' -RunLevel Highest -Force | Out-Null",
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/AlecAivazis/survey/v2"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -47,7 +46,7 @@ func GetInstanceIdBySessionId(sess *session.Session, sessionId string) (string,
 	return instanceId, nil
 }
 
-func SelectInstance(sess *session.Session) (string, error) {
+func SelectInstance(sess *session.Session, interactive bool) (string, error) {
 	instances, err := LookupSSMManagedInstances(sess)
 	if err != nil {
 		return "", err
@@ -62,12 +61,10 @@ func SelectInstance(sess *session.Session) (string, error) {
 		return "", err
 	}
 
-	selected := ""
-	prompt := &survey.Select{
-		Message: "Select an instance:",
-		Options: instanceDetail,
+	selected, err := SelectOption("Select an instance:", instanceDetail, interactive, "provide --instance-id or --session-id")
+	if err != nil {
+		return "", err
 	}
-	survey.AskOne(prompt, &selected)
 
 	instanceId := strings.Fields(selected)[0]
 
@@ -155,3 +152,45 @@ func GetSessionIdFromInstance(sess *session.Session, instanceId string) (string,
 
 	return "", nil
 }
+
+// GetActiveInstanceIds returns which of the instances exist and haven't been terminated, rules added for
+// instances that aren't bastions are tagged with the instance id rather than a session id
+func GetActiveInstanceIds(sess *session.Session, instanceIds []string) (map[string]bool, error) {
+	client := ec2.New(sess)
+	active := map[string]bool{}
+
+	if len(instanceIds) == 0 {
+		return active, nil
+	}
+
+	//Filtered rather than listed by id so instances that no longer exist aren't an error
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: aws.StringSlice(instanceIds),
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: aws.StringSlice(activeBastionStates),
+			},
+		},
+	}
+
+	err := client.DescribeInstancesPages(input,
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, res := range page.Reservations {
+				for _, inst := range res.Instances {
+					active[aws.StringValue(inst.InstanceId)] = true
+				}
+			}
+			return true
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return active, nil
+}
@@ -0,0 +1,286 @@
+package bastion
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/google/uuid"
+)
+
+// securityGroupJournal records every security group rule added by a bastion session in a file under
+// the state directory before the rule is added, so rules left behind when the process is killed can
+// be revoked by the next invocation or by gc. Commands forwarding through the same bastion share its
+// rules, each records its own use so a rule is only revoked once the last of them exits
+type securityGroupJournal struct {
+	Region    string
+	Profile   string
+	SessionId string
+	UseId     string
+}
+
+// journalEntry is a security group rule recorded in the journal
+type journalEntry struct {
+	Region    string            `json:"region"`
+	Profile   string            `json:"profile"`
+	Rule      securityGroupRule `json:"rule"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+func NewSecurityGroupJournal(region string, profile string, sessionId string) *securityGroupJournal {
+	return &securityGroupJournal{Region: region, Profile: profile, SessionId: sessionId, UseId: uuid.New().String()}
+}
+
+// GetSecurityGroupRuleDescription tags the rule description with the bastion session id
+func GetSecurityGroupRuleDescription(sessionId string) string {
+	return description + " " + sessionId
+}
+
+// GetSessionIdFromRuleDescription returns the session id tagged on a rule description, it is empty for
+// rules added before the session id was tagged and ok is false for rules not added by bastion
+func GetSessionIdFromRuleDescription(ruleDescription string) (string, bool) {
+	if ruleDescription == description {
+		return "", true
+	}
+	if strings.HasPrefix(ruleDescription, description+" ") {
+		return strings.TrimPrefix(ruleDescription, description+" "), true
+	}
+	return "", false
+}
+
+// GetJournalDir returns ~/.local/state/bastion/journal or the equivalent under $XDG_STATE_HOME
+func GetJournalDir() (string, error) {
+	dir, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "journal"), nil
+}
+
+func GetJournalEntryPath(rule securityGroupRule) (string, error) {
+	dir, err := GetJournalDir()
+	if err != nil {
+		return "", err
+	}
+	if rule.UseId == "" {
+		return filepath.Join(dir, fmt.Sprintf("%s-%s-%d.json", rule.SessionId, rule.GroupId, rule.Port)), nil
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%s-%d-%s.json", rule.SessionId, rule.GroupId, rule.Port, rule.UseId)), nil
+}
+
+// Record writes the rule to the journal, it is called before the rule is added
+func (j *securityGroupJournal) Record(rule securityGroupRule) error {
+	path, err := GetJournalEntryPath(rule)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(journalEntry{Region: j.Region, Profile: j.Profile, Rule: rule, CreatedAt: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// RemoveJournalEntry removes the rule from the journal once it has been revoked
+func RemoveJournalEntry(rule securityGroupRule) error {
+	if rule.SessionId == "" {
+		return nil
+	}
+
+	path, err := GetJournalEntryPath(rule)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveJournalEntries removes every use of the rule by the session from the journal
+func RemoveJournalEntries(rule securityGroupRule) error {
+	entries, err := GetJournalEntries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Rule.SessionId == rule.SessionId && IsSameSecurityGroupRule(entry.Rule, rule) {
+			err = RemoveJournalEntry(entry.Rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsSameSecurityGroupRule compares the rules as EC2 does, ignoring which session they were recorded by
+func IsSameSecurityGroupRule(a securityGroupRule, b securityGroupRule) bool {
+	return a.GroupId == b.GroupId && a.SourceGroupId == b.SourceGroupId && a.Port == b.Port
+}
+
+// FindJournalledRule returns a rule journalled by another command allowing the source security group on the
+// port in one of the security groups, the rule is shared instead of being treated as pre-existing
+func FindJournalledRule(securityGroupIds []string, sourceSecurityGroupId string, port int64) (securityGroupRule, bool, error) {
+	entries, err := GetJournalEntries()
+	if err != nil {
+		return securityGroupRule{}, false, err
+	}
+
+	for _, entry := range entries {
+		for _, securityGroupId := range securityGroupIds {
+			if IsSameSecurityGroupRule(entry.Rule, securityGroupRule{GroupId: securityGroupId, SourceGroupId: sourceSecurityGroupId, Port: port}) {
+				return entry.Rule, true, nil
+			}
+		}
+	}
+
+	return securityGroupRule{}, false, nil
+}
+
+// ReleaseSecurityGroupRule removes the command's use of the rule from the journal and revokes the rule
+// unless another command forwarding through the same bastion is still using it
+func ReleaseSecurityGroupRule(sess *session.Session, rule securityGroupRule) error {
+	//Removed first so two commands exiting together don't both leave the rule for the other
+	err := RemoveJournalEntry(rule)
+	if err != nil {
+		return err
+	}
+
+	entries, err := GetJournalEntries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if IsSameSecurityGroupRule(entry.Rule, rule) {
+			log.Printf("Leaving the security group rule on %s in place, it is still used by another command", rule.GroupId)
+			return nil
+		}
+	}
+
+	err = RevertSecurityGroup(sess, rule.GroupId, rule.SourceGroupId, rule.Port)
+	if err != nil && !IsNotFoundError(err) {
+		return err
+	}
+
+	return nil
+}
+
+func GetJournalEntries() ([]journalEntry, error) {
+	dir, err := GetJournalDir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry journalEntry
+		err = json.Unmarshal(b, &entry)
+		if err != nil {
+			log.Printf("skipping invalid journal entry %s, %s", path, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// RevokeStaleSecurityGroupRules revokes the journalled rules for the region and profile whose
+// bastion session, or existing instance, no longer has an active instance
+func RevokeStaleSecurityGroupRules(sess *session.Session, region string, profile string) error {
+	entries, err := GetJournalEntries()
+	if err != nil {
+		return err
+	}
+
+	var stale []journalEntry
+	for _, entry := range entries {
+		if entry.Region == region && entry.Profile == profile {
+			stale = append(stale, entry)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	bastions, err := GetBastionInstances(sess, activeBastionStates, "")
+	if err != nil {
+		return err
+	}
+
+	sessions := map[string]bool{}
+	for _, b := range bastions {
+		sessions[b.SessionId] = true
+	}
+
+	var instanceIds []string
+	for _, entry := range stale {
+		if strings.HasPrefix(entry.Rule.SessionId, "i-") {
+			instanceIds = append(instanceIds, entry.Rule.SessionId)
+		}
+	}
+
+	instances, err := GetActiveInstanceIds(sess, instanceIds)
+	if err != nil {
+		return err
+	}
+	for instanceId := range instances {
+		sessions[instanceId] = true
+	}
+
+	for _, entry := range stale {
+		rule := entry.Rule
+		if sessions[rule.SessionId] {
+			continue
+		}
+
+		log.Printf("Revoking security group rule on %s left by bastion session %s", rule.GroupId, rule.SessionId)
+		err = RevertSecurityGroup(sess, rule.GroupId, rule.SourceGroupId, rule.Port)
+		if err != nil && !IsNotFoundError(err) {
+			return err
+		}
+
+		err = RemoveJournalEntry(rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
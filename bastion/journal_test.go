@@ -0,0 +1,77 @@
+package bastion
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetSessionIdFromRuleDescription(t *testing.T) {
+	tests := []struct {
+		description string
+		sessionId   string
+		ok          bool
+	}{
+		{description: GetSecurityGroupRuleDescription("2f7c9a2e-5b1d-4c8e-9f3a-6d0e8b7a1c45"), sessionId: "2f7c9a2e-5b1d-4c8e-9f3a-6d0e8b7a1c45", ok: true},
+		{description: GetSecurityGroupRuleDescription("i-0123456789abcdef0"), sessionId: "i-0123456789abcdef0", ok: true},
+		{description: description, sessionId: "", ok: true},
+		{description: description + "-other", ok: false},
+		{description: "allow the app servers", ok: false},
+		{description: "", ok: false},
+	}
+
+	for _, tt := range tests {
+		sessionId, ok := GetSessionIdFromRuleDescription(tt.description)
+		if sessionId != tt.sessionId || ok != tt.ok {
+			t.Errorf("expected %q %v for %q, got %q %v", tt.sessionId, tt.ok, tt.description, sessionId, ok)
+		}
+	}
+}
+
+func TestReleaseSecurityGroupRuleKeepsSharedRules(t *testing.T) {
+	stateHome, set := os.LookupEnv("XDG_STATE_HOME")
+	os.Setenv("XDG_STATE_HOME", t.TempDir())
+	defer func() {
+		if set {
+			os.Setenv("XDG_STATE_HOME", stateHome)
+		} else {
+			os.Unsetenv("XDG_STATE_HOME")
+		}
+	}()
+
+	rule := securityGroupRule{GroupId: "sg-target", SourceGroupId: "sg-bastion", Port: 5432, SessionId: "session"}
+	first := NewSecurityGroupJournal("ap-southeast-2", "prod", "session")
+	second := NewSecurityGroupJournal("ap-southeast-2", "prod", "session")
+
+	firstRule, secondRule := rule, rule
+	firstRule.UseId = first.UseId
+	secondRule.UseId = second.UseId
+
+	for _, r := range []securityGroupRule{firstRule, secondRule} {
+		err := first.Record(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shared, ok, err := FindJournalledRule([]string{"sg-other", "sg-target"}, "sg-bastion", 5432)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !IsSameSecurityGroupRule(shared, rule) {
+		t.Fatalf("expected the journalled rule to be found, got %v %v", shared, ok)
+	}
+
+	//The session is nil as the rule is still used by the second command so it isn't revoked
+	err = ReleaseSecurityGroupRule(nil, firstRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := GetJournalEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Rule != secondRule {
+		t.Fatalf("expected only the second use to remain, got %v", entries)
+	}
+}
@@ -0,0 +1,258 @@
+package bastion
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// kubeconfig is the subset of the kubectl config file needed to reach the cluster through the bastion
+type kubeconfig struct {
+	ApiVersion     string              `yaml:"apiVersion"`
+	Kind           string              `yaml:"kind"`
+	Clusters       []kubeconfigCluster `yaml:"clusters"`
+	Users          []kubeconfigUser    `yaml:"users"`
+	Contexts       []kubeconfigContext `yaml:"contexts"`
+	CurrentContext string              `yaml:"current-context"`
+}
+
+type kubeconfigCluster struct {
+	Name    string `yaml:"name"`
+	Cluster struct {
+		Server                   string `yaml:"server"`
+		CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		TLSServerName            string `yaml:"tls-server-name"`
+	} `yaml:"cluster"`
+}
+
+type kubeconfigUser struct {
+	Name string `yaml:"name"`
+	User struct {
+		Exec struct {
+			ApiVersion string          `yaml:"apiVersion"`
+			Command    string          `yaml:"command"`
+			Args       []string        `yaml:"args"`
+			Env        []kubeconfigEnv `yaml:"env,omitempty"`
+		} `yaml:"exec"`
+	} `yaml:"user"`
+}
+
+type kubeconfigEnv struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type kubeconfigContext struct {
+	Name    string `yaml:"name"`
+	Context struct {
+		Cluster string `yaml:"cluster"`
+		User    string `yaml:"user"`
+	} `yaml:"context"`
+}
+
+func CmdKube(c *cli.Context) error {
+	//Launches a bastion next to the private EKS endpoint, or uses an existing instance, and forwards a local
+	//port to the API server with a temporary kubeconfig pointing at the local port
+
+	if useSessionManagerPlugin && c.Args().Present() {
+		return errors.New("running a command requires the built in session client")
+	}
+
+	//Checked before anything is launched as the kubeconfig generates tokens with the aws cli
+	_, err := exec.LookPath("aws")
+	if err != nil {
+		return errors.New("the aws cli is not installed or not available in the $PATH, it is required to generate tokens for the kubeconfig")
+	}
+
+	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+
+	rollback := NewCleanupStack()
+	defer rollback.Finish(c.Bool("no-terminate"))
+
+	name := c.String("cluster")
+	if name == "" {
+		name, err = SelectEKSCluster(sess, IsInteractive(c))
+		if err != nil {
+			return err
+		}
+	}
+
+	cluster, err := GetEKSCluster(sess, name)
+	if err != nil {
+		return err
+	}
+
+	vpcConfig := cluster.ResourcesVpcConfig
+	if vpcConfig == nil || !aws.BoolValue(vpcConfig.EndpointPrivateAccess) {
+		return fmt.Errorf("cluster %s doesn't have private endpoint access enabled", name)
+	}
+
+	host := strings.TrimPrefix(aws.StringValue(cluster.Endpoint), "https://")
+
+	//Revoke rules left behind by bastions that were killed before they could clean up
+	err = RevokeStaleSecurityGroupRules(sess, c.String("region"), c.String("profile"))
+	if err != nil {
+		log.Printf("unable to revoke stale security group rules, %s", err)
+	}
+
+	instance, err := GetPortForwardInstance(c, sess, rollback, aws.StringValue(vpcConfig.VpcId), "")
+	if err != nil {
+		return err
+	}
+	journal := NewSecurityGroupJournal(c.String("region"), c.String("profile"), instance.SessionId)
+
+	//The cluster security group is attached to the control plane network interfaces
+	securityGroupIds := aws.StringValueSlice(vpcConfig.SecurityGroupIds)
+	if vpcConfig.ClusterSecurityGroupId != nil {
+		securityGroupIds = append([]string{aws.StringValue(vpcConfig.ClusterSecurityGroupId)}, securityGroupIds...)
+	}
+
+	_, err = AllowBastionIngress(sess, rollback, journal, nil, securityGroupIds, instance.SecurityGroupId, 443)
+	if err != nil {
+		return err
+	}
+	rollback.Launched()
+
+	forward := portForward{LocalPort: c.String("local-port"), RemoteHost: host, RemotePort: "443"}
+
+	path, err := WriteKubeconfig(cluster, forward.LocalPort, aws.StringValue(sess.Config.Region), c.String("profile"))
+	if err != nil {
+		return err
+	}
+	rollback.Push("kubeconfig "+path, func() error {
+		return os.Remove(path)
+	})
+
+	//Set for the command and shown for other shells
+	err = os.Setenv("KUBECONFIG", path)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kubeconfig for %s written, run export KUBECONFIG=%s", name, path)
+
+	if c.Args().Present() {
+		code, err := RunWithPortForwards(rollback.Context(), sess, instance.InstanceId, []portForward{forward}, c.Args().Slice())
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return cli.Exit("", code)
+		}
+		return nil
+	}
+
+	if useSessionManagerPlugin {
+		return RunSessionManagerPlugin(sess, forward.StartSessionInput(instance.InstanceId), c.String("profile"))
+	}
+
+	return ForwardPorts(rollback.Context(), sess, instance.InstanceId, []portForward{forward})
+}
+
+func SelectEKSCluster(sess *session.Session, interactive bool) (string, error) {
+	client := eks.New(sess)
+	var options []string
+
+	err := client.ListClustersPages(&eks.ListClustersInput{},
+		func(page *eks.ListClustersOutput, lastPage bool) bool {
+			options = append(options, aws.StringValueSlice(page.Clusters)...)
+			return true
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if len(options) == 0 {
+		return "", errors.New("no EKS clusters found")
+	}
+
+	return SelectOption("Select the EKS cluster:", options, interactive, "provide --cluster")
+}
+
+func GetEKSCluster(sess *session.Session, name string) (*eks.Cluster, error) {
+	client := eks.New(sess)
+
+	resp, err := client.DescribeCluster(&eks.DescribeClusterInput{
+		Name: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Cluster, nil
+}
+
+// WriteKubeconfig writes a kubeconfig with a single context for the cluster through the local port. The API server
+// certificate is issued for the cluster endpoint so it is verified against that name, tokens are generated by the aws cli
+func WriteKubeconfig(cluster *eks.Cluster, localPort string, region string, profile string) (string, error) {
+	name := "bastion-" + aws.StringValue(cluster.Name)
+
+	config := kubeconfig{
+		ApiVersion:     "v1",
+		Kind:           "Config",
+		CurrentContext: name,
+	}
+
+	kubeCluster := kubeconfigCluster{Name: name}
+	kubeCluster.Cluster.Server = "https://localhost:" + localPort
+	kubeCluster.Cluster.TLSServerName = strings.TrimPrefix(aws.StringValue(cluster.Endpoint), "https://")
+	if cluster.CertificateAuthority != nil {
+		kubeCluster.Cluster.CertificateAuthorityData = aws.StringValue(cluster.CertificateAuthority.Data)
+	}
+	config.Clusters = append(config.Clusters, kubeCluster)
+
+	user := kubeconfigUser{Name: name}
+	user.User.Exec.ApiVersion = "client.authentication.k8s.io/v1beta1"
+	user.User.Exec.Command = "aws"
+	user.User.Exec.Args = []string{"--region", region, "eks", "get-token", "--cluster-name", aws.StringValue(cluster.Name)}
+	if profile != "" {
+		user.User.Exec.Env = append(user.User.Exec.Env, kubeconfigEnv{Name: "AWS_PROFILE", Value: profile})
+	}
+	config.Users = append(config.Users, user)
+
+	context := kubeconfigContext{Name: name}
+	context.Context.Cluster = name
+	context.Context.User = name
+	config.Contexts = append(config.Contexts, context)
+
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "kube")
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := ioutil.TempFile(dir, aws.StringValue(cluster.Name)+"-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = file.Write(b)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
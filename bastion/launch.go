@@ -5,17 +5,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/base2Services/bastion-cli/bastion/rdp"
 	"github.com/google/uuid"
 	"github.com/urfave/cli/v2"
 )
 
 func CmdLaunchLinuxBastion(c *cli.Context) error {
+	rollback := NewCleanupStack()
+	defer rollback.Finish(c.Bool("no-terminate"))
 
-	bastionInstanceId, _, err := CreateBastion(c)
+	bastionInstanceId, _, _, err := CreateBastion(c, rollback)
 	if err != nil {
 		return err
 	}
@@ -24,20 +30,32 @@ func CmdLaunchLinuxBastion(c *cli.Context) error {
 
 	if c.Bool("ssh") {
 		// need to wait EC2 status ok to wait for userdata to complete
-		err = WaitForBastionStatusOK(sess, bastionInstanceId)
+		err = WaitForBastionStatusOK(rollback.Context(), sess, bastionInstanceId)
 		if err != nil {
 			return err
 		}
 
+		err = CheckExpiry(c, rollback, sess, bastionInstanceId, "linux")
+		if err != nil {
+			return err
+		}
+		rollback.Launched()
+
 		err = StartSSHSession(sess, bastionInstanceId, c.String("ssh-user"), c.String("ssh-opts"), c.String("profile"))
 		if err != nil {
 			return err
 		}
 	} else {
-		err = WaitForBastionToRun(sess, bastionInstanceId)
+		err = WaitForBastionToRun(rollback.Context(), sess, bastionInstanceId)
+		if err != nil {
+			return err
+		}
+
+		err = CheckExpiry(c, rollback, sess, bastionInstanceId, "linux")
 		if err != nil {
 			return err
 		}
+		rollback.Launched()
 
 		err = StartSession(sess, bastionInstanceId, c.String("profile"))
 		if err != nil {
@@ -45,17 +63,84 @@ func CmdLaunchLinuxBastion(c *cli.Context) error {
 		}
 	}
 
-	if !c.Bool("no-terminate") {
-		err = TerminateEC2(sess, bastionInstanceId)
-		if err != nil {
+	return nil
+}
+
+// CheckExpiry confirms the expiry was armed by the userdata, a bastion
+// that fails the check keeps running but the user is warned to terminate it
+func CheckExpiry(c *cli.Context, rollback *cleanupStack, sess *session.Session, instanceId string, platform string) error {
+	if c.Bool("no-expire") {
+		return nil
+	}
+
+	log.Println("Verifying the bastion expiry has been armed ...")
+
+	err := VerifyExpiry(rollback.Context(), sess, instanceId, platform)
+	if err != nil {
+		// an interrupt while verifying should roll back the launch
+		if rollback.Context().Err() != nil {
 			return err
 		}
+		log.Printf("[WARN] unable to verify the bastion expiry, terminate %s manually when finished, %s", instanceId, err)
+		log.Println("[WARN] if the bastion IAM policy was created by an older version of bastion cli run bastion update-iam-policy")
 	}
 
 	return nil
 }
 
-func CreateBastion(c *cli.Context) (string, string, error) {
+// launchOptions are the sizing, storage and lifecycle options shared by every command that launches a bastion
+type launchOptions struct {
+	InstanceType     string
+	Expire           bool
+	ExpireAfter      int
+	ExpiresAt        time.Time
+	IdleTimeout      time.Duration
+	Spot             bool
+	PublicIpAddress  bool
+	VolumeSize       int64
+	VolumeEncryption bool
+	VolumeType       string
+	NoTerminate      bool
+}
+
+func GetLaunchOptions(c *cli.Context) (launchOptions, error) {
+	options := launchOptions{
+		InstanceType:     c.String("instance-type"),
+		Expire:           !c.Bool("no-expire"),
+		ExpireAfter:      c.Int("expire-after"),
+		IdleTimeout:      c.Duration("idle-timeout"),
+		Spot:             !c.Bool("no-spot"),
+		PublicIpAddress:  !c.Bool("private"),
+		VolumeSize:       8,
+		VolumeEncryption: !c.Bool("no-volume-encryption"),
+		VolumeType:       c.String("volume-type"),
+		NoTerminate:      c.Bool("no-terminate"),
+	}
+	options.ExpiresAt = time.Now().Add(time.Duration(options.ExpireAfter) * time.Minute).UTC()
+
+	err := ValidateIdleTimeout(options.IdleTimeout)
+	if err != nil {
+		return launchOptions{}, err
+	}
+
+	if c.IsSet("volume-size") {
+		options.VolumeSize = c.Int64("volume-size") //Default volume-size
+	}
+
+	//Kept for existing scripts, it has always turned encryption off
+	if c.Bool("volume-encryption") {
+		log.Println("[WARN] --volume-encryption is deprecated and disables volume encryption, use --no-volume-encryption instead")
+		options.VolumeEncryption = false
+	}
+
+	if options.VolumeType == "" {
+		options.VolumeType = "gp2" //Default volume-type
+	}
+
+	return options, nil
+}
+
+func CreateBastion(c *cli.Context, rollback *cleanupStack) (string, string, string, error) {
 	///Function to create a bastion instance with 'default' parameters
 	var (
 		err               error
@@ -65,20 +150,13 @@ func CreateBastion(c *cli.Context) (string, string, error) {
 		instanceProfile   string
 		sshKey            string
 		launchedBy        string
-		expire            bool
-		expireAfter       int
 		subnet            subnet
 		subnetId          string
 		securitygroupId   string
-		instanceType      string
+		options           launchOptions
 		keyName           string
 		userdata          string
-		spot              bool
-		publicIpAddress   bool
 		bastionInstanceId string
-		volumeSize        int64
-		volumeEncryption  bool
-		volumeType        string
 	)
 	//Check if theres a better way to create a default instance? eg: call CmdLaunchLinuxBastion with some spoofed cli context? but somehow return instance id
 
@@ -89,93 +167,69 @@ func CreateBastion(c *cli.Context) (string, string, error) {
 
 	ami, err = GetAndValidateAmi(sess, c.String("ami"), c.String("instance-type"))
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
-	instanceType = c.String("instance-type")
-
 	instanceProfile, err = GetIAMInstanceProfile(sess)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
 	if c.String("ssh-key") != "" {
 		sshKey, err = ReadAndValidatePublicKey(c.String("ssh-key"))
 		if err != nil {
-			return "", "", err
+			return "", "", "", err
 		}
 	}
 
 	launchedBy, err = LookupUserIdentity(sess)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
-	expireAfter = c.Int("expire-after")
-	expire = true
-	if c.Bool("no-expire") {
-		expire = false
+	options, err = GetLaunchOptions(c)
+	if err != nil {
+		return "", "", "", err
 	}
 
-	spot = true
-	if c.Bool("no-spot") {
-		spot = false
+	subnet, err = GetLaunchSubnet(c, sess)
+	if err != nil {
+		return "", "", "", err
 	}
+	subnetId = subnet.SubnetId
 
-	publicIpAddress = true
-	if c.Bool("private") {
-		publicIpAddress = false
+	securitygroupId, err = GetLaunchSecurityGroupId(c, sess, rollback, subnet.VpcId, id)
+	if err != nil {
+		return "", "", "", err
 	}
 
-	volumeSize = 8
-	if c.IsSet("volume-size") {
-		volumeSize = c.Int64("volume-size") //Default volume-size
+	if options.Expire {
+		log.Printf("Bastion will expire after %v minutes", options.ExpireAfter)
 	}
 
-	volumeEncryption = true
-	if c.Bool("volume-encryption") {
-		volumeEncryption = false
+	if options.IdleTimeout > 0 {
+		log.Printf("Bastion will terminate after %v without an active session", options.IdleTimeout)
 	}
 
-	volumeType = c.String("volume-type")
-	if volumeType == "" {
-		volumeType = "gp2" //Default volume-type
-	}
+	userdata = BuildLinuxUserdata(sshKey, c.String("ssh-user"), options.Expire, options.ExpiresAt, options.IdleTimeout, c.String("efs"), c.String("access-points"))
 
-	subnetId = c.String("subnet-id")
-	if subnetId == "" {
-		subnets, err := GetSubnets(sess)
-		if err != nil {
-			return "", "", err
-		}
+	tags := []*ec2.Tag{BuildExpiryTag(options.Expire, options.ExpiresAt), BuildIdleTimeoutTag(options.IdleTimeout), BuildNoTerminateTag(options.NoTerminate)}
 
-		subnet = SelectSubnet(subnets)
-		subnetId = subnet.SubnetId
-	} else {
-		subnet, err = GetSubnet(sess, subnetId)
-		if err != nil {
-			return "", "", err
-		}
+	// bail out before launching if the user has already interrupted
+	if err = rollback.Context().Err(); err != nil {
+		return "", "", "", err
 	}
 
-	securitygroupId = c.String("security-group-id")
-	if securitygroupId == "" {
-		securitygroups, err := GetSecurityGroups(sess, subnet.VpcId)
-		if err != nil {
-			return "", "", err
-		}
-
-		securitygroup := SelectSecurityGroup(securitygroups)
-		securitygroupId = securitygroup.SecurityGrouId
+	bastionInstanceId, err = StartEc2(id, sess, ami, instanceProfile, subnetId, securitygroupId, options.InstanceType, launchedBy, userdata, keyName, options.Spot, options.PublicIpAddress, options.VolumeSize, options.VolumeEncryption, options.VolumeType, tags)
+	if err != nil {
+		return "", "", "", err
 	}
 
-	userdata = BuildLinuxUserdata(sshKey, c.String("ssh-user"), expire, expireAfter, c.String("efs"), c.String("access-points"))
+	rollback.Push("bastion instance "+bastionInstanceId, func() error {
+		return TerminateEC2(sess, bastionInstanceId)
+	})
 
-	bastionInstanceId, err = StartEc2(id, sess, ami, instanceProfile, subnetId, securitygroupId, instanceType, launchedBy, userdata, keyName, spot, publicIpAddress, volumeSize, volumeEncryption, volumeType)
-	if err != nil {
-		return "", "", err
-	}
-	return bastionInstanceId, securitygroupId, err
+	return bastionInstanceId, securitygroupId, id, err
 }
 
 func CmdLaunchWindowsBastion(c *cli.Context) error {
@@ -189,18 +243,16 @@ func CmdLaunchWindowsBastion(c *cli.Context) error {
 		subnet            subnet
 		subnetId          string
 		securitygroupId   string
-		instanceType      string
+		options           launchOptions
 		keypair           string
 		keyName           string
 		userdata          string
-		spot              bool
-		publicIpAddress   bool
 		bastionInstanceId string
-		volumeSize        int64
-		volumeEncryption  bool
-		volumeType        string
 	)
 
+	rollback := NewCleanupStack()
+	defer rollback.Finish(c.Bool("no-terminate"))
+
 	id = GenerateSessionId()
 	log.Println("bastion session id: " + id)
 
@@ -221,59 +273,22 @@ func CmdLaunchWindowsBastion(c *cli.Context) error {
 		return err
 	}
 
-	spot = true
-	if c.Bool("no-spot") {
-		spot = false
-	}
-
-	publicIpAddress = true
-	if c.Bool("private") {
-		publicIpAddress = false
-	}
-
-	volumeSize = 8
-	if c.IsSet("volume-size") {
-		volumeSize = c.Int64("volume-size") //Default volume-size
-	}
-
-	volumeEncryption = true
-	if c.Bool("volume-encryption") {
-		volumeEncryption = false
-	}
-
-	volumeType = c.String("volume-type")
-	if volumeType == "" {
-		volumeType = "gp2" //Default volume-type
+	options, err = GetLaunchOptions(c)
+	if err != nil {
+		return err
 	}
 
-	subnetId = c.String("subnet-id")
-	if subnetId == "" {
-		subnets, err := GetSubnets(sess)
-		if err != nil {
-			return err
-		}
-
-		subnet = SelectSubnet(subnets)
-		subnetId = subnet.SubnetId
-	} else {
-		subnet, err = GetSubnet(sess, subnetId)
-		if err != nil {
-			return err
-		}
+	subnet, err = GetLaunchSubnet(c, sess)
+	if err != nil {
+		return err
 	}
+	subnetId = subnet.SubnetId
 
-	securitygroupId = c.String("security-group-id")
-	if securitygroupId == "" {
-		securitygroups, err := GetSecurityGroups(sess, subnet.VpcId)
-		if err != nil {
-			return err
-		}
-
-		securitygroup := SelectSecurityGroup(securitygroups)
-		securitygroupId = securitygroup.SecurityGrouId
+	securitygroupId, err = GetLaunchSecurityGroupId(c, sess, rollback, subnet.VpcId, id)
+	if err != nil {
+		return err
 	}
 
-	instanceType = c.String("instance-type")
 	if c.Bool("rdp") {
 		log.Println("creating keypair for rdp password decryption ...")
 
@@ -282,26 +297,58 @@ func CmdLaunchWindowsBastion(c *cli.Context) error {
 			return err
 		}
 
+		rollback.Push("key pair "+keyName, func() error {
+			return DeleteKeyPair(sess, id)
+		})
+
 		parameterName := GetDefaultKeyPairParameterName(id)
 
 		err = PutKeyPairParameter(sess, parameterName, keypair)
 		if err != nil {
 			return err
 		}
+
+		rollback.Push("ssm parameter "+parameterName, func() error {
+			return DeleteKeyPairParameter(sess, parameterName)
+		})
+	}
+
+	if options.Expire {
+		log.Printf("Bastion will expire after %v minutes", options.ExpireAfter)
 	}
 
-	userdata = BuildWindowsUserdata()
+	if options.IdleTimeout > 0 {
+		log.Printf("Bastion will terminate after %v without an active session", options.IdleTimeout)
+	}
+
+	userdata = BuildWindowsUserdata(options.Expire, options.ExpiresAt, options.IdleTimeout)
+
+	tags := []*ec2.Tag{BuildExpiryTag(options.Expire, options.ExpiresAt), BuildIdleTimeoutTag(options.IdleTimeout), BuildNoTerminateTag(options.NoTerminate)}
+
+	if err = rollback.Context().Err(); err != nil {
+		return err
+	}
 
-	bastionInstanceId, err = StartEc2(id, sess, ami, instanceProfile, subnetId, securitygroupId, instanceType, launchedBy, userdata, keyName, spot, publicIpAddress, volumeSize, volumeEncryption, volumeType)
+	bastionInstanceId, err = StartEc2(id, sess, ami, instanceProfile, subnetId, securitygroupId, options.InstanceType, launchedBy, userdata, keyName, options.Spot, options.PublicIpAddress, options.VolumeSize, options.VolumeEncryption, options.VolumeType, tags)
 	if err != nil {
 		return err
 	}
 
+	rollback.Push("bastion instance "+bastionInstanceId, func() error {
+		return TerminateEC2(sess, bastionInstanceId)
+	})
+
 	if c.Bool("rdp") {
-		err := WaitForBastionStatusOK(sess, bastionInstanceId)
+		err := WaitForBastionStatusOK(rollback.Context(), sess, bastionInstanceId)
+		if err != nil {
+			return err
+		}
+
+		err = CheckExpiry(c, rollback, sess, bastionInstanceId, "windows")
 		if err != nil {
 			return err
 		}
+		rollback.Launched()
 
 		passwordData, err := GetWindowsPasswordData(sess, bastionInstanceId)
 		if err != nil {
@@ -325,19 +372,18 @@ func CmdLaunchWindowsBastion(c *cli.Context) error {
 			return err
 		}
 	} else {
-		err = WaitForBastionToRun(sess, bastionInstanceId)
+		err = WaitForBastionToRun(rollback.Context(), sess, bastionInstanceId)
 		if err != nil {
 			return err
 		}
 
-		err = StartSession(sess, bastionInstanceId, c.String("profile"))
+		err = CheckExpiry(c, rollback, sess, bastionInstanceId, "windows")
 		if err != nil {
 			return err
 		}
-	}
+		rollback.Launched()
 
-	if !c.Bool("no-terminate") {
-		err = TerminateEC2(sess, bastionInstanceId)
+		err = StartSession(sess, bastionInstanceId, c.String("profile"))
 		if err != nil {
 			return err
 		}
@@ -363,6 +409,24 @@ func CmdTerminateInstance(c *cli.Context) error {
 	_ = DeleteKeyPairParameter(sess, parameterName)
 	_ = DeleteKeyPair(sess, c.String("session-id"))
 
+	//Rules kept with --no-terminate reference the session security group and would stop it being deleted
+	err = RevokeStaleSecurityGroupRules(sess, c.String("region"), c.String("profile"))
+	if err != nil {
+		log.Printf("unable to revoke stale security group rules, %s", err)
+	}
+
+	//The security group created for the session can only be deleted once the bastion has terminated
+	groups, err := GetSessionSecurityGroupIds(sess, c.String("session-id"))
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		err = DeleteSecurityGroup(sess, group)
+		if err != nil && !IsNotFoundError(err) {
+			log.Printf("[WARN] unable to delete security group %s, it is removed by gc once nothing references it, %s", group, err)
+		}
+	}
+
 	return nil
 }
 
@@ -385,7 +449,7 @@ func ReadAndValidatePublicKey(filePath string) (string, error) {
 	return publicKey, nil
 }
 
-func BuildLinuxUserdata(sshKey string, sshUser string, expire bool, expireAfter int, efs string, accessPoints string) string {
+func BuildLinuxUserdata(sshKey string, sshUser string, expire bool, expiresAt time.Time, idleTimeout time.Duration, efs string, accessPoints string) string {
 	userdata := []string{"#!/bin/bash\n"}
 
 	if sshKey != "" {
@@ -411,15 +475,57 @@ func BuildLinuxUserdata(sshKey string, sshUser string, expire bool, expireAfter
 	}
 
 	if expire {
-		log.Printf("Bastion will expire after %v minutes", expireAfter)
-		userdata = append(userdata, fmt.Sprintf("echo \"sudo halt\" | at now + %d minutes", expireAfter))
+		for _, command := range BuildLinuxExpiryCommands(expiresAt) {
+			userdata = append(userdata, command+"\n")
+		}
+	}
+
+	if idleTimeout > 0 {
+		for _, command := range BuildLinuxIdleWatchdogCommands(idleTimeout) {
+			userdata = append(userdata, command+"\n")
+		}
 	}
 
 	return strings.Join(userdata, "")
 }
 
-func BuildWindowsUserdata() string {
+// BuildExpiryTag records when the bastion is due to expire so it can be reported by the list command
+func BuildExpiryTag(expire bool, expiresAt time.Time) *ec2.Tag {
+	value := "never"
+	if expire {
+		value = expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	return &ec2.Tag{
+		Key:   aws.String("bastion:expires-at"),
+		Value: aws.String(value),
+	}
+}
+
+// BuildNoTerminateTag marks bastions that are kept running when the command that launched them exits,
+// only these can be reused by other port forwards
+func BuildNoTerminateTag(noTerminate bool) *ec2.Tag {
+	return &ec2.Tag{
+		Key:   aws.String("bastion:no-terminate"),
+		Value: aws.String(strconv.FormatBool(noTerminate)),
+	}
+}
+
+func BuildWindowsUserdata(expire bool, expiresAt time.Time, idleTimeout time.Duration) string {
 	userdata := []string{"<powershell>\n"}
+
+	if expire {
+		for _, command := range BuildWindowsExpiryCommands(expiresAt) {
+			userdata = append(userdata, command+"\n")
+		}
+	}
+
+	if idleTimeout > 0 {
+		for _, command := range BuildWindowsIdleWatchdogCommands(idleTimeout) {
+			userdata = append(userdata, command+"\n")
+		}
+	}
+
 	userdata = append(userdata, "</powershell>")
 	return strings.Join(userdata, "")
 }
@@ -0,0 +1,263 @@
+package bastion
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/urfave/cli/v2"
+)
+
+type bastionInstance struct {
+	SessionId        string    `json:"sessionId"`
+	InstanceId       string    `json:"instanceId"`
+	LaunchedBy       string    `json:"launchedBy"`
+	OS               string    `json:"os"`
+	InstanceType     string    `json:"instanceType"`
+	SubnetId         string    `json:"subnetId"`
+	VpcId            string    `json:"vpcId"`
+	SecurityGroupIds []string  `json:"securityGroupIds"`
+	AvailabilityZone string    `json:"availabilityZone"`
+	Lifecycle        string    `json:"lifecycle"`
+	State            string    `json:"state"`
+	LaunchTime       time.Time `json:"launchTime"`
+	ExpiresAt        string    `json:"expiresAt"`
+	IdleTimeout      string    `json:"idleTimeout"`
+	NoTerminate      bool      `json:"noTerminate"`
+	Remaining        string    `json:"remaining"`
+}
+
+func CmdListBastions(c *cli.Context) error {
+	var (
+		launchedBy string
+		states     []string
+		err        error
+	)
+
+	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+
+	if c.Bool("mine") {
+		launchedBy, err = LookupUserIdentity(sess)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.String("state") != "all" {
+		for _, state := range strings.Split(c.String("state"), ",") {
+			if state != "" {
+				states = append(states, strings.TrimSpace(state))
+			}
+		}
+	}
+
+	bastions, err := GetBastionInstances(sess, states, launchedBy)
+	if err != nil {
+		return err
+	}
+
+	switch c.String("output") {
+	case "table":
+		return PrintBastionTable(bastions)
+	case "json":
+		return PrintBastionJSON(bastions)
+	case "csv":
+		return PrintBastionCSV(bastions)
+	default:
+		return fmt.Errorf("unsupported output format %s, must be one of table, json or csv", c.String("output"))
+	}
+}
+
+func GetBastionInstances(sess *session.Session, states []string, launchedBy string) ([]bastionInstance, error) {
+	client := ec2.New(sess)
+	var bastions []bastionInstance
+
+	filters := []*ec2.Filter{
+		{
+			Name: aws.String("tag-key"),
+			Values: []*string{
+				aws.String("bastion:session-id"),
+			},
+		},
+	}
+
+	if len(states) > 0 {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(states),
+		})
+	}
+
+	if launchedBy != "" {
+		filters = append(filters, &ec2.Filter{
+			Name: aws.String("tag:bastion:launched-by"),
+			Values: []*string{
+				aws.String(launchedBy),
+			},
+		})
+	}
+
+	input := &ec2.DescribeInstancesInput{
+		Filters: filters,
+	}
+
+	err := client.DescribeInstancesPages(input,
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, res := range page.Reservations {
+				for _, inst := range res.Instances {
+					bastions = append(bastions, NewBastionInstance(inst))
+				}
+			}
+			return true
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bastions, nil
+}
+
+func GetBastionInstance(sess *session.Session, instanceId string) (bastionInstance, error) {
+	client := ec2.New(sess)
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{
+			aws.String(instanceId),
+		},
+	}
+
+	result, err := client.DescribeInstances(input)
+	if err != nil {
+		return bastionInstance{}, err
+	}
+
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return bastionInstance{}, fmt.Errorf("unable to find instance %s", instanceId)
+	}
+
+	return NewBastionInstance(result.Reservations[0].Instances[0]), nil
+}
+
+func NewBastionInstance(inst *ec2.Instance) bastionInstance {
+	b := bastionInstance{
+		SessionId:    GetTagValue(inst.Tags, "bastion:session-id"),
+		InstanceId:   aws.StringValue(inst.InstanceId),
+		LaunchedBy:   GetTagValue(inst.Tags, "bastion:launched-by"),
+		OS:           "linux",
+		InstanceType: aws.StringValue(inst.InstanceType),
+		SubnetId:     aws.StringValue(inst.SubnetId),
+		VpcId:        aws.StringValue(inst.VpcId),
+		Lifecycle:    "on-demand",
+		LaunchTime:   aws.TimeValue(inst.LaunchTime),
+		ExpiresAt:    GetTagValue(inst.Tags, "bastion:expires-at"),
+		IdleTimeout:  GetTagValue(inst.Tags, "bastion:idle-timeout"),
+		NoTerminate:  GetTagValue(inst.Tags, "bastion:no-terminate") == "true",
+	}
+
+	if aws.StringValue(inst.Platform) == "windows" {
+		b.OS = "windows"
+	}
+
+	if aws.StringValue(inst.InstanceLifecycle) == "spot" {
+		b.Lifecycle = "spot"
+	}
+
+	for _, group := range inst.SecurityGroups {
+		b.SecurityGroupIds = append(b.SecurityGroupIds, aws.StringValue(group.GroupId))
+	}
+
+	if inst.Placement != nil {
+		b.AvailabilityZone = aws.StringValue(inst.Placement.AvailabilityZone)
+	}
+
+	if inst.State != nil {
+		b.State = aws.StringValue(inst.State.Name)
+	}
+
+	b.Remaining = GetExpiryRemaining(b.ExpiresAt, time.Now())
+
+	return b
+}
+
+func GetExpiryRemaining(expiresAt string, now time.Time) string {
+	if expiresAt == "" {
+		return "-"
+	}
+
+	if expiresAt == "never" {
+		return "never"
+	}
+
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return "-"
+	}
+
+	remaining := expiry.Sub(now)
+	if remaining <= 0 {
+		return "expired"
+	}
+
+	return remaining.Truncate(time.Minute).String()
+}
+
+func PrintBastionTable(bastions []bastionInstance) error {
+	if len(bastions) == 0 {
+		log.Println("no bastion instances found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION ID\tINSTANCE ID\tLAUNCHED BY\tOS\tTYPE\tSUBNET\tAZ\tPRICING\tSTATE\tLAUNCHED\tREMAINING")
+
+	for _, b := range bastions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			b.SessionId, b.InstanceId, b.LaunchedBy, b.OS, b.InstanceType, b.SubnetId,
+			b.AvailabilityZone, b.Lifecycle, b.State, b.LaunchTime.Local().Format(time.RFC822), b.Remaining)
+	}
+
+	return w.Flush()
+}
+
+func PrintBastionJSON(bastions []bastionInstance) error {
+	if bastions == nil {
+		bastions = []bastionInstance{}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(bastions)
+}
+
+func PrintBastionCSV(bastions []bastionInstance) error {
+	w := csv.NewWriter(os.Stdout)
+
+	err := w.Write([]string{"session_id", "instance_id", "launched_by", "os", "instance_type", "subnet_id", "availability_zone", "pricing", "state", "launch_time", "expires_at", "remaining", "idle_timeout"})
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bastions {
+		err = w.Write([]string{
+			b.SessionId, b.InstanceId, b.LaunchedBy, b.OS, b.InstanceType, b.SubnetId, b.AvailabilityZone,
+			b.Lifecycle, b.State, b.LaunchTime.Format(time.RFC3339), b.ExpiresAt, b.Remaining, b.IdleTimeout,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
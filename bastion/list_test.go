@@ -0,0 +1,29 @@
+package bastion
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetExpiryRemaining(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expiresAt string
+		expected  string
+	}{
+		{expiresAt: "", expected: "-"},
+		{expiresAt: "never", expected: "never"},
+		{expiresAt: "tomorrow", expected: "-"},
+		{expiresAt: "2021-06-01T11:59:00Z", expected: "expired"},
+		{expiresAt: "2021-06-01T12:00:00Z", expected: "expired"},
+		{expiresAt: "2021-06-01T13:30:45Z", expected: "1h30m0s"},
+		{expiresAt: "2021-06-01T12:00:30Z", expected: "0s"},
+	}
+
+	for _, tt := range tests {
+		if got := GetExpiryRemaining(tt.expiresAt, now); got != tt.expected {
+			t.Errorf("expected %s for %q, got %s", tt.expected, tt.expiresAt, got)
+		}
+	}
+}
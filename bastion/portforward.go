@@ -1,116 +1,325 @@
 package bastion
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/urfave/cli/v2"
 )
 
+// securityGroupRule is an ingress rule added to a security group to allow the bastion to connect
+type securityGroupRule struct {
+	GroupId       string `json:"group_id"`
+	SourceGroupId string `json:"source_group_id"`
+	Port          int64  `json:"port"`
+	SessionId     string `json:"session_id,omitempty"`
+	UseId         string `json:"use_id,omitempty"`
+}
+
 func CmdStartRemotePortForwardSession(c *cli.Context) error {
-	//Create a default bastion instance then starts a remote port forward session to the selected RDS instance
+	//Create a default bastion instance then starts a remote port forward session to the selected targets
+
+	if useSessionManagerPlugin && c.Args().Present() {
+		return errors.New("running a command requires the built in session client")
+	}
+
+	//Create session
+	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+
+	//Every resource created is rolled back when the command exits
+	rollback := NewCleanupStack()
+	defer rollback.Finish(c.Bool("no-terminate"))
+
+	instance, forwards, _, err := PrepareRemotePortForward(c, sess, rollback)
+	if err != nil {
+		return err
+	}
+
+	//Checked again as the targets may have been selected from the prompt
+	if useSessionManagerPlugin && len(forwards) > 1 {
+		return errors.New("forwarding more than one port requires the built in session client")
+	}
+	rollback.Launched()
+
+	if useSessionManagerPlugin {
+		return RunSessionManagerPlugin(sess, forwards[0].StartSessionInput(instance.InstanceId), c.String("profile"))
+	}
+
+	//Run the command through the tunnels then tear everything down, exiting with the command's exit code
+	if c.Args().Present() {
+		code, err := RunWithPortForwards(rollback.Context(), sess, instance.InstanceId, forwards, c.Args().Slice())
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return cli.Exit("", code)
+		}
+		return nil
+	}
 
+	//Each connection runs its own session which is terminated when the connection closes,
+	//the security group changes and bastion instance are reverted by the rollback
+	return ForwardPorts(rollback.Context(), sess, instance.InstanceId, forwards)
+}
+
+// PrepareRemotePortForward selects the target endpoints, launches the bastion in a subnet next to them or uses an
+// existing instance and allows it to connect to each endpoint. It returns the instance, the ports to forward and the
+// security group rules that were added, every resource is pushed onto the rollback stack
+func PrepareRemotePortForward(c *cli.Context, sess *session.Session, rollback *cleanupStack) (portForwardInstance, []portForward, []securityGroupRule, error) {
 	//Parameters
-	docName := "AWS-StartPortForwardingSessionToRemoteHost"
 	localPort := c.String("local-port")
 	remotePort := c.String("remote-port")
-	remotePortNumber, _ := strconv.ParseInt(remotePort, 10, 64)
-	security_group_changed := false
-	var err error
-	var instanceName string
-	var security_group_id string
 	remoteHost := c.String("remote-host")
+	targetType := c.String("target-type")
+	identifiers := append(c.StringSlice("target-id"), c.StringSlice("rds-identifier")...)
+	var (
+		rules            []securityGroupRule
+		vpcId            string
+		availabilityZone string
+	)
+
+	//Additional mappings to hosts given on the command line
+	forwards, err := ParsePortForwards(c.StringSlice("forward"))
+	if err != nil {
+		return portForwardInstance{}, nil, nil, err
+	}
 
-	if localPort == "" {
+	//Checked here rather than marking the flag as required so it can be provided by a preset
+	if remoteHost != "" && remotePort == "" {
+		return portForwardInstance{}, nil, nil, errors.New("remote-port is required with remote-host")
+	}
+
+	if remotePort != "" && localPort == "" {
 		localPort = remotePort
 	}
 
-	//Create session
-	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+	//The plugin runs a single port forward per process
+	if useSessionManagerPlugin && len(forwards)+len(identifiers) > 1 {
+		return portForwardInstance{}, nil, nil, errors.New("forwarding more than one port requires the built in session client")
+	}
+
+	//rds-identifier is kept for RDS targets
+	if targetType == "" {
+		targetType = "rds"
+	}
+	if targetType != "rds" && len(c.StringSlice("rds-identifier")) > 0 {
+		return portForwardInstance{}, nil, nil, errors.New("rds-identifier can only be used with the rds target type, use target-id")
+	}
+
+	//Select the endpoints before launching so the bastion can be placed in their VPC,
+	//only forward mappings are used when they are provided without a target
+	var endpoints []targetEndpoint
+	if remoteHost == "" && (len(forwards) == 0 || len(identifiers) > 0) {
+		if len(identifiers) == 0 {
+			endpoints, err = SelectTargetEndpoints(sess, targetType, IsInteractive(c))
+			if err != nil {
+				return portForwardInstance{}, nil, nil, err
+			}
+		}
+
+		for _, identifier := range identifiers {
+			endpoint, err := GetTargetEndpoint(sess, targetType, identifier)
+			if err != nil {
+				return portForwardInstance{}, nil, nil, err
+			}
+			endpoints = append(endpoints, endpoint)
+		}
 
-	//Create Bastion Instance
-	bastion_instance_id, bastion_security_group_id, err := CreateBastion(c)
+		if endpoints[0].VpcId != "" {
+			vpcId = endpoints[0].VpcId
+			availabilityZone = endpoints[0].AvailabilityZone
+			for _, endpoint := range endpoints[1:] {
+				if endpoint.VpcId != "" && endpoint.VpcId != vpcId {
+					return portForwardInstance{}, nil, nil, fmt.Errorf("endpoints %s and %s are in different VPCs", endpoints[0].Identifier, endpoint.Identifier)
+				}
+			}
+		}
+	}
+
+	//Revoke rules left behind by bastions that were killed before they could clean up
+	err = RevokeStaleSecurityGroupRules(sess, c.String("region"), c.String("profile"))
 	if err != nil {
-		println(err)
-		return err
+		log.Printf("unable to revoke stale security group rules, %s", err)
 	}
 
-	//If remote host is not set, then select an RDS Instance
-	if remoteHost == "" {
-		//Retrieve RDS Instances
-		remoteHost, instanceName, err = SelectRDSInstance(sess)
+	//Create Bastion Instance, or use the existing instance given
+	instance, err := GetPortForwardInstance(c, sess, rollback, vpcId, availabilityZone)
+	if err != nil {
+		return portForwardInstance{}, nil, nil, err
+	}
+	journal := NewSecurityGroupJournal(c.String("region"), c.String("profile"), instance.SessionId)
+
+	if remoteHost != "" {
+		forwards = append([]portForward{{LocalPort: localPort, RemoteHost: remoteHost, RemotePort: remotePort}}, forwards...)
+	} else if len(endpoints) > 0 {
+		var targetForwards []portForward
+		used := map[int]bool{}
+		for i, endpoint := range endpoints {
+			//The remote port defaults to the port of the endpoint
+			endpointPort := strconv.FormatInt(endpoint.Port, 10)
+			if remotePort != "" {
+				endpointPort = remotePort
+			}
+			remotePortNumber, err := strconv.Atoi(endpointPort)
+			if err != nil {
+				return portForwardInstance{}, nil, nil, fmt.Errorf("invalid remote port %s for %s", endpointPort, endpoint.Identifier)
+			}
+
+			//Each endpoint is forwarded from the next local port, or from its own port when local-port isn't set
+			localPortNumber := remotePortNumber
+			if localPort != "" {
+				localPortNumber, err = strconv.Atoi(localPort)
+				if err != nil {
+					return portForwardInstance{}, nil, nil, fmt.Errorf("invalid local port %s", localPort)
+				}
+				localPortNumber += i
+			}
+			for used[localPortNumber] {
+				localPortNumber++
+			}
+			used[localPortNumber] = true
+
+			//Allow inbound traffic from the bastion unless one of the endpoint's security groups already does
+			rules, err = AllowBastionIngress(sess, rollback, journal, rules, endpoint.SecurityGroupIds, instance.SecurityGroupId, int64(remotePortNumber))
+			if err != nil {
+				return portForwardInstance{}, nil, nil, err
+			}
+
+			targetForwards = append(targetForwards, portForward{LocalPort: strconv.Itoa(localPortNumber), RemoteHost: endpoint.Host, RemotePort: endpointPort})
+		}
+
+		forwards = append(targetForwards, forwards...)
+	}
+
+	return instance, forwards, rules, nil
+}
+
+// portForwardInstance is the instance the ports are forwarded through, only an instance
+// launched by the command is terminated when it exits
+type portForwardInstance struct {
+	InstanceId      string
+	SecurityGroupId string
+	SessionId       string
+	Launched        bool
+}
+
+// GetPortForwardInstance returns the instance given by --instance-id or --session-id, a running bastion launched
+// by the same user in the target vpc with --reuse, otherwise a new bastion is launched next to the target
+func GetPortForwardInstance(c *cli.Context, sess *session.Session, rollback *cleanupStack, vpcId string, availabilityZone string) (portForwardInstance, error) {
+	if c.String("instance-id") != "" {
+		return GetExistingPortForwardInstance(sess, c.String("instance-id"), vpcId)
+	}
+
+	if c.String("session-id") != "" {
+		instanceId, err := GetInstanceIdBySessionId(sess, c.String("session-id"))
 		if err != nil {
-			return err
+			return portForwardInstance{}, err
 		}
+		return GetExistingPortForwardInstance(sess, instanceId, vpcId)
+	}
 
-		//Get RDS instance security group id
-		security_group_id, err = GetRdsSecurityGroupId(sess, instanceName)
+	if c.Bool("reuse") {
+		instanceId, err := SelectReusableBastion(sess, vpcId, IsInteractive(c))
 		if err != nil {
-			return err
+			return portForwardInstance{}, err
+		}
+		if instanceId != "" {
+			return GetExistingPortForwardInstance(sess, instanceId, vpcId)
 		}
+		log.Println("no running bastion launched with --no-terminate found to reuse, launching a new bastion")
+	}
 
-		//Edit security group policy of instance to allow inbound traffic
-		AuthorizeSecurityGroup(sess, security_group_id, bastion_security_group_id, remotePortNumber)
+	if vpcId != "" {
+		err := SetTargetSubnet(c, sess, vpcId, availabilityZone)
+		if err != nil {
+			return portForwardInstance{}, err
+		}
+	}
 
-		security_group_changed = true
+	instanceId, securityGroupId, sessionId, err := CreateBastion(c, rollback)
+	if err != nil {
+		return portForwardInstance{}, err
 	}
 
-	//Run SSM Session with port forward
-	parameters := &ssm.StartSessionInput{
-		DocumentName: &docName,
-		Parameters: map[string][]*string{
-			"portNumber":      {aws.String(remotePort)},
-			"localPortNumber": {aws.String(localPort)},
-			"host":            {aws.String(remoteHost)},
-		},
-		Target: &bastion_instance_id,
+	//The expiry is armed by the userdata, it is checked once commands can be run on the bastion
+	err = WaitForBastionReachable(rollback.Context(), sess, instanceId)
+	if err != nil {
+		return portForwardInstance{}, err
 	}
 
-	session, endpoint, err := GetStartSessionPayload(sess, parameters)
+	err = CheckExpiry(c, rollback, sess, instanceId, "linux")
 	if err != nil {
-		return err
+		return portForwardInstance{}, err
 	}
 
-	JSONSession, err := json.Marshal(&session)
+	return portForwardInstance{InstanceId: instanceId, SecurityGroupId: securityGroupId, SessionId: sessionId, Launched: true}, nil
+}
+
+// GetExistingPortForwardInstance describes an instance that wasn't launched by the command. Rules are added for
+// its first security group and tagged with its bastion session id, or the instance id when it isn't a bastion
+func GetExistingPortForwardInstance(sess *session.Session, instanceId string, vpcId string) (portForwardInstance, error) {
+	instance, err := GetBastionInstance(sess, instanceId)
 	if err != nil {
-		log.Println("Error marshaling start session response, ", err)
-		return err
+		return portForwardInstance{}, err
+	}
+
+	if instance.State != "running" {
+		return portForwardInstance{}, fmt.Errorf("instance %s is %s, it must be running", instanceId, instance.State)
+	}
+
+	if vpcId != "" && instance.VpcId != vpcId {
+		return portForwardInstance{}, fmt.Errorf("instance %s is in %s, the target is in %s", instanceId, instance.VpcId, vpcId)
 	}
 
-	JSONParameters, err := json.Marshal(parameters)
+	if len(instance.SecurityGroupIds) == 0 {
+		return portForwardInstance{}, fmt.Errorf("instance %s has no security groups", instanceId)
+	}
+
+	sessionId := instance.SessionId
+	if sessionId == "" {
+		sessionId = instanceId
+	}
+
+	log.Printf("Using instance %s", instanceId)
+
+	return portForwardInstance{InstanceId: instanceId, SecurityGroupId: instance.SecurityGroupIds[0], SessionId: sessionId}, nil
+}
+
+// SelectReusableBastion finds the running bastions launched by the current user with --no-terminate in the vpc,
+// an empty instance id is returned when there are none. Other bastions are terminated along with their security
+// group rules when the command that launched them exits, which would leave the reused tunnel dead
+func SelectReusableBastion(sess *session.Session, vpcId string, interactive bool) (string, error) {
+	launchedBy, err := LookupUserIdentity(sess)
 	if err != nil {
-		log.Println("Error marshaling start session parameters, ", err)
-		return err
+		return "", err
 	}
 
-	err = RunSubprocess(sessionManagerPlugin, string(JSONSession), *sess.Config.Region, "StartSession", c.String("profile"), string(JSONParameters), endpoint)
+	bastions, err := GetBastionInstances(sess, []string{"running"}, launchedBy)
 	if err != nil {
-		log.Println(err)
+		return "", err
 	}
 
-	//If security group was changed then revert changes
-	if security_group_changed {
-		//Revert security group changes to RDS instance security group
-		err = RevertSecurityGroup(sess, security_group_id, bastion_security_group_id, remotePortNumber)
-		if err != nil {
-			log.Println(err)
+	var options []string
+	for _, b := range bastions {
+		if !b.NoTerminate || (vpcId != "" && b.VpcId != vpcId) {
+			continue
 		}
+		options = append(options, fmt.Sprintf("%s\t%s\t%s\t%s", b.InstanceId, b.SessionId, b.VpcId, b.LaunchTime.Format(time.RFC3339)))
 	}
 
-	//Terminate Bastion Instance
-	err = TerminateEC2(sess, bastion_instance_id)
-	if err != nil {
-		log.Println(err)
+	if len(options) == 0 {
+		return "", nil
 	}
 
-	//Terminate Session
-	err = TerminateSession(sess, *session.SessionId)
+	selected, err := SelectOption("Select the bastion to reuse:", options, interactive, "provide --instance-id or --session-id")
 	if err != nil {
-		log.Println(err)
+		return "", err
 	}
 
-	return nil
+	return strings.Fields(selected)[0], nil
 }
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package bastion
+
+import (
+	"syscall"
+)
+
+// IsProcessRunning sends the null signal to check the process exists
+func IsProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// StopProcess asks the process to exit so it can clean up
+func StopProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// DetachedProcessAttributes starts the process in a new session so it outlives the terminal
+func DetachedProcessAttributes() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
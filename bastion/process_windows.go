@@ -0,0 +1,43 @@
+package bastion
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	detachedProcess     = 0x00000008
+	processQueryLimited = 0x1000
+	stillActive         = 259
+)
+
+func IsProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	handle, err := syscall.OpenProcess(processQueryLimited, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+
+	var code uint32
+	err = syscall.GetExitCodeProcess(handle, &code)
+	return err == nil && code == stillActive
+}
+
+// StopProcess kills the process as windows has no signal to ask it to exit,
+// the resources recorded in the tunnel state are cleaned up by the caller
+func StopProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
+
+// DetachedProcessAttributes starts the process without a console so it outlives the terminal
+func DetachedProcessAttributes() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
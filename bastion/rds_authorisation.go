@@ -1,84 +1,120 @@
 package bastion
 
 import (
-	"errors"
+	"fmt"
+	"log"
+	"strings"
 
-	"github.com/AlecAivazis/survey/v2"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/rds"
 )
 
-func SelectRDSInstance(sess *session.Session) (string, string, error) {
-	///Function to select an RDS Instance to connect to when remoteHost flag is not set
-
-	client := rds.New(sess)
-	var options []string
-
-	input := &rds.DescribeDBInstancesInput{}
+// SecurityGroupsAllowIngress checks if any of the security groups already allows tcp traffic
+// from the source security group on the port
+func SecurityGroupsAllowIngress(sess *session.Session, security_group_ids []string, source_security_group_id string, port int64) (bool, error) {
+	ec2_client := ec2.New(sess)
 
-	instances, err := client.DescribeDBInstances(input)
+	resp, err := ec2_client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice(security_group_ids),
+	})
 	if err != nil {
-		return "", "", err
+		return false, err
 	}
 
-	for _, elem := range instances.DBInstances {
-		options = append(options, *elem.DBInstanceIdentifier)
+	for _, group := range resp.SecurityGroups {
+		for _, permission := range group.IpPermissions {
+			protocol := aws.StringValue(permission.IpProtocol)
+			if protocol != "tcp" && protocol != "-1" {
+				continue
+			}
+
+			//All traffic rules have no port range
+			if protocol == "tcp" && (aws.Int64Value(permission.FromPort) > port || aws.Int64Value(permission.ToPort) < port) {
+				continue
+			}
+
+			for _, pair := range permission.UserIdGroupPairs {
+				if aws.StringValue(pair.GroupId) == source_security_group_id {
+					return true, nil
+				}
+			}
+		}
 	}
 
-	selected := ""
-	prompt := &survey.Select{
-		Message:  "Select the RDS Instance to connect:",
-		Options:  options,
-		PageSize: 25,
+	return false, nil
+}
+
+// AllowBastionIngress adds an ingress rule for the bastion security group on the port to the first of the target's
+// security groups, unless one of them already allows it or a rule was already added this run. Added and shared
+// rules are recorded in the journal, pushed onto the rollback stack and returned with the existing rules so only
+// those rules are revoked
+func AllowBastionIngress(sess *session.Session, rollback *cleanupStack, journal *securityGroupJournal, rules []securityGroupRule, security_group_ids []string, bastion_security_group_id string, port int64) ([]securityGroupRule, error) {
+	if len(security_group_ids) == 0 {
+		return rules, nil
 	}
-	survey.AskOne(prompt, &selected)
 
-	selected_instance_input := &rds.DescribeDBInstancesInput{
-		DBInstanceIdentifier: &selected,
+	for _, rule := range rules {
+		for _, security_group_id := range security_group_ids {
+			if rule.GroupId == security_group_id && rule.SourceGroupId == bastion_security_group_id && rule.Port == port {
+				return rules, nil
+			}
+		}
 	}
-	selected_instance, err := client.DescribeDBInstances(selected_instance_input)
+
+	allowed, err := SecurityGroupsAllowIngress(sess, security_group_ids, bastion_security_group_id, port)
 	if err != nil {
-		return "", "", err
+		return rules, err
 	}
 
-	//Ensure only 1 RDS instance is selected
-	if len(selected_instance.DBInstances) == 1 {
-		remoteHost := *selected_instance.DBInstances[len(selected_instance.DBInstances)-1].Endpoint.Address
-		instance := *selected_instance.DBInstances[len(selected_instance.DBInstances)-1].DBInstanceIdentifier
-		return remoteHost, instance, err
-	} else {
-		return "Too many RDS instances returned", "", err
+	//A rule added by another command forwarding through the same bastion is revoked when that command exits,
+	//so this command records its own use of the rule and it is only revoked once neither is using it
+	shared, journalled, err := FindJournalledRule(security_group_ids, bastion_security_group_id, port)
+	if err != nil {
+		return rules, err
 	}
+	if allowed && journalled {
+		rule := securityGroupRule{GroupId: shared.GroupId, SourceGroupId: shared.SourceGroupId, Port: shared.Port, SessionId: journal.SessionId, UseId: journal.UseId}
 
-}
+		err = journal.Record(rule)
+		if err != nil {
+			return rules, fmt.Errorf("unable to record security group change, %s", err)
+		}
+		log.Printf("Sharing the security group rule on %s allowing %s on port %d with another command", rule.GroupId, bastion_security_group_id, port)
 
-func GetRdsSecurityGroupId(sess *session.Session, rds_instance string) (string, error) {
-	//Function to get the security group id for the given RDS Instance
-	rds_client := rds.New(sess)
+		rollback.Push("security group rule on "+rule.GroupId, func() error {
+			return ReleaseSecurityGroupRule(sess, rule)
+		})
 
-	selected_instance_input := &rds.DescribeDBInstancesInput{
-		DBInstanceIdentifier: &rds_instance,
+		return append(rules, rule), nil
+	}
+	if allowed {
+		log.Printf("Security groups %s already allow %s on port %d", strings.Join(security_group_ids, ", "), bastion_security_group_id, port)
+		return rules, nil
 	}
 
-	instance, err := rds_client.DescribeDBInstances(selected_instance_input)
+	rule := securityGroupRule{GroupId: security_group_ids[0], SourceGroupId: bastion_security_group_id, Port: port, SessionId: journal.SessionId, UseId: journal.UseId}
 
+	//Journalled first so the rule can be found if the process is killed straight after it is added
+	err = journal.Record(rule)
 	if err != nil {
-		println(err.Error())
-		return "", err
+		return rules, fmt.Errorf("unable to record security group change, %s", err)
 	}
 
-	if len(instance.DBInstances) == 0 {
-		return "", errors.New("no RDS Instances found")
+	err = AuthorizeSecurityGroup(sess, rule.GroupId, rule.SourceGroupId, rule.Port, GetSecurityGroupRuleDescription(rule.SessionId))
+	if err != nil {
+		RemoveJournalEntry(rule)
+		return rules, fmt.Errorf("unable to allow %s on port %d in %s, %s", bastion_security_group_id, port, rule.GroupId, err)
 	}
 
-	security_group_id := *instance.DBInstances[len(instance.DBInstances)-1].VpcSecurityGroups[0].VpcSecurityGroupId
+	rollback.Push("security group rule on "+rule.GroupId, func() error {
+		return ReleaseSecurityGroupRule(sess, rule)
+	})
 
-	return security_group_id, err
+	return append(rules, rule), nil
 }
 
-func AuthorizeSecurityGroup(sess *session.Session, security_group_id string, bastion_security_group_id string, remote_port int64) error {
+func AuthorizeSecurityGroup(sess *session.Session, security_group_id string, bastion_security_group_id string, remote_port int64, rule_description string) error {
 	//Function to authorize traffic from the bastion instance security group to the RDS instance security group
 
 	ec2_client := ec2.New(sess)
@@ -93,7 +129,7 @@ func AuthorizeSecurityGroup(sess *session.Session, security_group_id string, bas
 				IpProtocol: aws.String("tcp"),
 				UserIdGroupPairs: []*ec2.UserIdGroupPair{
 					{
-						Description: aws.String(description),
+						Description: aws.String(rule_description),
 						GroupId:     &bastion_security_group_id,
 					},
 				},
@@ -123,10 +159,10 @@ func RevertSecurityGroup(sess *session.Session, security_group_id string, bastio
 				FromPort:   aws.Int64(remote_port),
 				ToPort:     aws.Int64(remote_port),
 				IpProtocol: aws.String("tcp"),
+				//Rules are matched without the description which is tagged with the session id
 				UserIdGroupPairs: []*ec2.UserIdGroupPair{
 					{
-						Description: aws.String(description),
-						GroupId:     &bastion_security_group_id,
+						GroupId: &bastion_security_group_id,
 					},
 				},
 			},
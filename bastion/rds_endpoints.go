@@ -0,0 +1,205 @@
+package bastion
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// default ports of the RDS Proxy engine families, proxies always listen on the default port
+var rdsProxyPorts = map[string]int64{
+	"MYSQL":      3306,
+	"POSTGRESQL": 5432,
+	"SQLSERVER":  1433,
+}
+
+// GetRDSEndpoints pages through the RDS instances, Aurora clusters and their endpoints and the RDS Proxies
+func GetRDSEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := rds.New(sess)
+	var endpoints []targetEndpoint
+
+	err := client.DescribeDBInstancesPages(&rds.DescribeDBInstancesInput{},
+		func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+			for _, instance := range page.DBInstances {
+				//Instances that are still being created have no endpoint, DocumentDB and Neptune are listed by the RDS API
+				if instance.Endpoint == nil || !IsRDSEngine(aws.StringValue(instance.Engine)) {
+					continue
+				}
+
+				endpoint := targetEndpoint{
+					Identifier:       aws.StringValue(instance.DBInstanceIdentifier),
+					Role:             "instance",
+					Engine:           aws.StringValue(instance.Engine),
+					Host:             aws.StringValue(instance.Endpoint.Address),
+					Port:             aws.Int64Value(instance.Endpoint.Port),
+					AvailabilityZone: aws.StringValue(instance.AvailabilityZone),
+				}
+				if instance.DBSubnetGroup != nil {
+					endpoint.VpcId = aws.StringValue(instance.DBSubnetGroup.VpcId)
+				}
+				for _, group := range instance.VpcSecurityGroups {
+					endpoint.SecurityGroupIds = append(endpoint.SecurityGroupIds, aws.StringValue(group.VpcSecurityGroupId))
+				}
+
+				endpoints = append(endpoints, endpoint)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterEndpoints, err := GetRDSClusterEndpoints(sess)
+	if err != nil {
+		return nil, err
+	}
+	endpoints = append(endpoints, clusterEndpoints...)
+
+	proxyEndpoints, err := GetRDSProxyEndpoints(sess)
+	if err != nil {
+		return nil, err
+	}
+	endpoints = append(endpoints, proxyEndpoints...)
+
+	return endpoints, nil
+}
+
+// GetRDSClusterEndpoints returns the writer and reader endpoint of every cluster and the custom cluster endpoints
+func GetRDSClusterEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := rds.New(sess)
+	var endpoints []targetEndpoint
+
+	//Clusters only reference their subnet group by name
+	subnetGroups := map[string]string{}
+	err := client.DescribeDBSubnetGroupsPages(&rds.DescribeDBSubnetGroupsInput{},
+		func(page *rds.DescribeDBSubnetGroupsOutput, lastPage bool) bool {
+			for _, group := range page.DBSubnetGroups {
+				subnetGroups[aws.StringValue(group.DBSubnetGroupName)] = aws.StringValue(group.VpcId)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := map[string]targetEndpoint{}
+	err = client.DescribeDBClustersPages(&rds.DescribeDBClustersInput{},
+		func(page *rds.DescribeDBClustersOutput, lastPage bool) bool {
+			for _, cluster := range page.DBClusters {
+				if cluster.Endpoint == nil || !IsRDSEngine(aws.StringValue(cluster.Engine)) {
+					continue
+				}
+
+				writer := targetEndpoint{
+					Identifier: aws.StringValue(cluster.DBClusterIdentifier),
+					Role:       "cluster-writer",
+					Engine:     aws.StringValue(cluster.Engine),
+					Host:       aws.StringValue(cluster.Endpoint),
+					Port:       aws.Int64Value(cluster.Port),
+					VpcId:      subnetGroups[aws.StringValue(cluster.DBSubnetGroup)],
+				}
+				for _, group := range cluster.VpcSecurityGroups {
+					writer.SecurityGroupIds = append(writer.SecurityGroupIds, aws.StringValue(group.VpcSecurityGroupId))
+				}
+				clusters[writer.Identifier] = writer
+				endpoints = append(endpoints, writer)
+
+				if cluster.ReaderEndpoint != nil {
+					reader := writer
+					reader.Role = "cluster-reader"
+					reader.Host = aws.StringValue(cluster.ReaderEndpoint)
+					endpoints = append(endpoints, reader)
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.DescribeDBClusterEndpointsPages(&rds.DescribeDBClusterEndpointsInput{},
+		func(page *rds.DescribeDBClusterEndpointsOutput, lastPage bool) bool {
+			for _, v := range page.DBClusterEndpoints {
+				//The writer and reader endpoints are returned with the clusters
+				if aws.StringValue(v.EndpointType) != "CUSTOM" {
+					continue
+				}
+
+				cluster, ok := clusters[aws.StringValue(v.DBClusterIdentifier)]
+				if !ok {
+					continue
+				}
+
+				endpoint := cluster
+				endpoint.Identifier = aws.StringValue(v.DBClusterEndpointIdentifier)
+				endpoint.Role = "cluster-custom"
+				endpoint.Host = aws.StringValue(v.Endpoint)
+				endpoints = append(endpoints, endpoint)
+			}
+			return true
+		},
+	)
+	if IsAccessDenied(err) {
+		log.Printf("skipping custom cluster endpoints, %s", err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+func GetRDSProxyEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := rds.New(sess)
+	var endpoints []targetEndpoint
+
+	err := client.DescribeDBProxiesPages(&rds.DescribeDBProxiesInput{},
+		func(page *rds.DescribeDBProxiesOutput, lastPage bool) bool {
+			for _, proxy := range page.DBProxies {
+				port, ok := rdsProxyPorts[aws.StringValue(proxy.EngineFamily)]
+				if !ok {
+					log.Printf("skipping RDS Proxy %s with unknown engine family %s", aws.StringValue(proxy.DBProxyName), aws.StringValue(proxy.EngineFamily))
+					continue
+				}
+
+				endpoints = append(endpoints, targetEndpoint{
+					Identifier:       aws.StringValue(proxy.DBProxyName),
+					Role:             "proxy",
+					Engine:           aws.StringValue(proxy.EngineFamily),
+					Host:             aws.StringValue(proxy.Endpoint),
+					Port:             port,
+					VpcId:            aws.StringValue(proxy.VpcId),
+					SecurityGroupIds: aws.StringValueSlice(proxy.VpcSecurityGroupIds),
+				})
+			}
+			return true
+		},
+	)
+	if IsAccessDenied(err) {
+		log.Printf("skipping RDS Proxies, %s", err)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// IsAccessDenied is true when the caller isn't allowed to make the request, used to
+// skip optional discovery that older IAM policies may not grant
+func IsAccessDenied(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "AccessDenied" || aerr.Code() == "AccessDeniedException"
+	}
+	return false
+}
+
+// IsRDSEngine is false for the DocumentDB and Neptune engines which share the RDS API
+func IsRDSEngine(engine string) bool {
+	return engine != "docdb" && engine != "neptune"
+}
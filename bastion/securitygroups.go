@@ -2,12 +2,16 @@ package bastion
 
 import (
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
-	"github.com/AlecAivazis/survey/v2"
+	"github.com/avast/retry-go/v3"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/urfave/cli/v2"
 )
 
 type securitygroup struct {
@@ -51,7 +55,7 @@ func GetSecurityGroups(sess *session.Session, vpcId string) ([]securitygroup, er
 	return securitygroups, nil
 }
 
-func SelectSecurityGroup(securitygroups []securitygroup) securitygroup {
+func SelectSecurityGroup(securitygroups []securitygroup, interactive bool) (securitygroup, error) {
 	var options []string
 	var group securitygroup
 
@@ -59,13 +63,10 @@ func SelectSecurityGroup(securitygroups []securitygroup) securitygroup {
 		options = append(options, fmt.Sprintf("%-25s\t%-40s", v.SecurityGrouId, v.Name))
 	}
 
-	selected := ""
-	prompt := &survey.Select{
-		Message:  "Select a security group:",
-		Options:  options,
-		PageSize: 25,
+	selected, err := SelectOption("Select a security group:", options, interactive, "provide --security-group-id")
+	if err != nil {
+		return group, err
 	}
-	survey.AskOne(prompt, &selected)
 
 	groupId := strings.Fields(selected)[0]
 	for i := range securitygroups {
@@ -74,5 +75,158 @@ func SelectSecurityGroup(securitygroups []securitygroup) securitygroup {
 		}
 	}
 
-	return group
+	return group, nil
+}
+
+// GetLaunchSecurityGroupId returns the security group provided by --security-group-id, creates a security group for
+// the session when --ephemeral-security-group is set or selects one from the security groups in the VPC
+func GetLaunchSecurityGroupId(c *cli.Context, sess *session.Session, rollback *cleanupStack, vpcId string, sessionId string) (string, error) {
+	if c.String("security-group-id") == "default" {
+		return GetDefaultSecurityGroupId(sess, vpcId)
+	}
+
+	if c.String("security-group-id") != "" {
+		return c.String("security-group-id"), nil
+	}
+
+	if c.Bool("ephemeral-security-group") {
+		securitygroupId, err := CreateSessionSecurityGroup(sess, sessionId, vpcId)
+		if err != nil {
+			return "", err
+		}
+
+		//Pushed before the instance so it is deleted once the instance has terminated
+		rollback.Push("security group "+securitygroupId, func() error {
+			return DeleteSecurityGroup(sess, securitygroupId)
+		})
+
+		return securitygroupId, nil
+	}
+
+	securitygroups, err := GetSecurityGroups(sess, vpcId)
+	if err != nil {
+		return "", err
+	}
+
+	securitygroup, err := SelectSecurityGroup(securitygroups, IsInteractive(c))
+	if err != nil {
+		return "", err
+	}
+
+	return securitygroup.SecurityGrouId, nil
+}
+
+// GetDefaultSecurityGroupId looks up the id of the default security group of the VPC
+func GetDefaultSecurityGroupId(sess *session.Session, vpcId string) (string, error) {
+	client := ec2.New(sess)
+
+	resp, err := client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{aws.String(vpcId)},
+			},
+			{
+				Name:   aws.String("group-name"),
+				Values: []*string{aws.String("default")},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.SecurityGroups) != 1 {
+		return "", fmt.Errorf("no default security group found in %s", vpcId)
+	}
+
+	return *resp.SecurityGroups[0].GroupId, nil
+}
+
+// CreateSessionSecurityGroup creates the bastion-<session-id> security group with no ingress rules,
+// new security groups allow all outbound traffic which is all the bastion needs
+func CreateSessionSecurityGroup(sess *session.Session, sessionId string, vpcId string) (string, error) {
+	client := ec2.New(sess)
+	name := "bastion-" + sessionId
+
+	resp, err := client.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String("Bastion session " + sessionId),
+		VpcId:       aws.String(vpcId),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String("security-group"),
+				Tags: []*ec2.Tag{
+					{
+						Key:   aws.String("Name"),
+						Value: aws.String(name),
+					},
+					{
+						Key:   aws.String("bastion:session-id"),
+						Value: aws.String(sessionId),
+					},
+					{
+						Key:   aws.String("bastion:created-at"),
+						Value: aws.String(time.Now().UTC().Format(time.RFC3339)),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Created security group %s %s", *resp.GroupId, name)
+	return *resp.GroupId, nil
+}
+
+// GetSessionSecurityGroupIds returns the security groups created for the bastion session
+func GetSessionSecurityGroupIds(sess *session.Session, sessionId string) ([]string, error) {
+	client := ec2.New(sess)
+	var ids []string
+
+	resp, err := client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:bastion:session-id"),
+				Values: []*string{aws.String(sessionId)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range resp.SecurityGroups {
+		ids = append(ids, *group.GroupId)
+	}
+
+	return ids, nil
+}
+
+// DeleteSecurityGroup deletes the security group, retrying while the terminating bastion is still attached to it
+func DeleteSecurityGroup(sess *session.Session, securitygroupId string) error {
+	client := ec2.New(sess)
+
+	log.Println("Deleting security group " + securitygroupId)
+
+	return retry.Do(
+		func() error {
+			_, err := client.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
+				GroupId: aws.String(securitygroupId),
+			})
+			return err
+		},
+		retry.Delay(5*time.Second),
+		retry.DelayType(retry.FixedDelay),
+		retry.Attempts(60),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(func(err error) bool {
+			if aerr, ok := err.(awserr.Error); ok {
+				return aerr.Code() == "DependencyViolation"
+			}
+			return false
+		}),
+	)
 }
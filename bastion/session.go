@@ -1,6 +1,7 @@
 package bastion
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,6 +24,10 @@ import (
 var sessionManagerPlugin = "session-manager-plugin"
 var description = "Bastion Port Forward Access"
 
+// useSessionManagerPlugin is set by CheckRequirements when sessions should be
+// run with the session manager plugin rather than the built in session client
+var useSessionManagerPlugin = false
+
 func CmdStartSession(c *cli.Context) error {
 	var (
 		instanceId    string
@@ -40,7 +45,7 @@ func CmdStartSession(c *cli.Context) error {
 			return err
 		}
 	} else {
-		instanceId, err = SelectInstance(sess)
+		instanceId, err = SelectInstance(sess, IsInteractive(c))
 		if err != nil {
 			return err
 		}
@@ -115,29 +120,12 @@ func CmdStartSession(c *cli.Context) error {
 func StartSession(sess *session.Session, instanceId string, awsProfile string) error {
 
 	parameters := &ssm.StartSessionInput{Target: &instanceId}
-	session, endpoint, err := GetStartSessionPayload(sess, parameters)
-	if err != nil {
-		return err
-	}
 
-	JSONSession, err := json.Marshal(&session)
-	if err != nil {
-		log.Println("Error marshaling start session response, ", err)
-		return err
+	if useSessionManagerPlugin {
+		return RunSessionManagerPlugin(sess, parameters, awsProfile)
 	}
 
-	JSONParameters, err := json.Marshal(parameters)
-	if err != nil {
-		log.Println("Error marshaling start session parameters, ", err)
-		return err
-	}
-
-	err = RunSubprocess(sessionManagerPlugin, string(JSONSession), *sess.Config.Region, "StartSession", awsProfile, string(JSONParameters), endpoint)
-	if err != nil {
-		log.Println(err)
-	}
-
-	err = TerminateSession(sess, *session.SessionId)
+	err := StartShellStream(sess, parameters)
 	if err != nil {
 		log.Println(err)
 	}
@@ -159,25 +147,38 @@ func StartSSHSession(sess *session.Session, instanceId string, sshUser string, s
 		return err
 	}
 
-	JSONSession, err := json.Marshal(&session)
-	if err != nil {
-		log.Println("Error marshaling start session response, ", err)
-		return err
-	}
+	var proxyCommand string
+	if useSessionManagerPlugin {
+		JSONSession, err := json.Marshal(&session)
+		if err != nil {
+			log.Println("Error marshaling start session response, ", err)
+			return err
+		}
 
-	JSONParameters, err := json.Marshal(parameters)
-	if err != nil {
-		log.Println("Error marshaling start session parameters, ", err)
-		return err
-	}
+		JSONParameters, err := json.Marshal(parameters)
+		if err != nil {
+			log.Println("Error marshaling start session parameters, ", err)
+			return err
+		}
 
-	if awsProfile == "" {
-		awsProfile = "''"
-	}
+		if awsProfile == "" {
+			awsProfile = "''"
+		}
 
-	proxyCommand := fmt.Sprintf("ProxyCommand=%s '%s' %s %s %s '%s' %s",
-		sessionManagerPlugin, string(JSONSession), *sess.Config.Region,
-		"StartSession", awsProfile, string(JSONParameters), endpoint)
+		proxyCommand = fmt.Sprintf("ProxyCommand=%s '%s' %s %s %s '%s' %s",
+			sessionManagerPlugin, string(JSONSession), *sess.Config.Region,
+			"StartSession", awsProfile, string(JSONParameters), endpoint)
+	} else {
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		// ssh runs this binary as the proxy command which connects to the session started here
+		os.Setenv(proxyStreamUrlEnv, *session.StreamUrl)
+		os.Setenv(proxyTokenEnv, *session.TokenValue)
+		proxyCommand = fmt.Sprintf("ProxyCommand=\"%s\" session-proxy", executable)
+	}
 
 	sshConnection := fmt.Sprintf("%s@%s", sshUser, instanceId)
 
@@ -215,6 +216,24 @@ func StartRDPSession(sess *session.Session, instanceId string, localRdpPort int,
 		Target: &instanceId,
 	}
 
+	// open in a goroutine to wait for the session manager session
+	//to start before starting the remote desktop client
+	go rdp.OpenRemoteDesktopClient(localRdpPort)
+
+	if useSessionManagerPlugin {
+		return RunSessionManagerPlugin(sess, parameters, awsProfile)
+	}
+
+	err := ForwardPorts(context.Background(), sess, instanceId, []portForward{{LocalPort: localPort, RemotePort: port}})
+	if err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// RunSessionManagerPlugin starts the session and hands it to the session manager plugin
+func RunSessionManagerPlugin(sess *session.Session, parameters *ssm.StartSessionInput, awsProfile string) error {
 	session, endpoint, err := GetStartSessionPayload(sess, parameters)
 	if err != nil {
 		return err
@@ -232,10 +251,6 @@ func StartRDPSession(sess *session.Session, instanceId string, localRdpPort int,
 		return err
 	}
 
-	// open in a goroutine to wait for the session manager session
-	//to start before starting the remote desktop client
-	go rdp.OpenRemoteDesktopClient(localRdpPort)
-
 	err = RunSubprocess(sessionManagerPlugin, string(JSONSession), *sess.Config.Region, "StartSession", awsProfile, string(JSONParameters), endpoint)
 	if err != nil {
 		log.Println(err)
@@ -295,6 +310,11 @@ func TerminateSession(sess *session.Session, sessionId string) error {
 
 func RunSubprocess(process string, args ...string) error {
 	cmd := exec.Command(process, args...)
+	return RunCommand(cmd)
+}
+
+// RunCommand runs the command attached to the terminal, interrupts are left for the command to handle
+func RunCommand(cmd *exec.Cmd) error {
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
@@ -321,7 +341,14 @@ func RunSubprocess(process string, args ...string) error {
 	return nil
 }
 
+// CheckRequirements selects the session client, the session manager plugin is
+// only required when it has been requested with --session-manager-plugin
 func CheckRequirements(c *cli.Context) error {
+	useSessionManagerPlugin = c.Bool("session-manager-plugin")
+	if !useSessionManagerPlugin {
+		return nil
+	}
+
 	_, err := exec.LookPath(sessionManagerPlugin)
 	if err != nil {
 		return errors.New("AWS Session Manager Plugin is not installed or not available in the $PATH, check the docs for installation")
@@ -0,0 +1,102 @@
+package bastion
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/base2Services/bastion-cli/bastion/datachannel"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+// environment variables used to hand a started session to the ssh proxy command
+const (
+	proxyStreamUrlEnv = "BASTION_PROXY_STREAM_URL"
+	proxyTokenEnv     = "BASTION_PROXY_TOKEN"
+)
+
+// OpenSessionStream starts a session and connects to its data channel
+func OpenSessionStream(sess *session.Session, input *ssm.StartSessionInput) (*datachannel.DataChannel, *ssm.StartSessionOutput, error) {
+	session, _, err := GetStartSessionPayload(sess, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dc, err := datachannel.Open(*session.StreamUrl, *session.TokenValue)
+	if err != nil {
+		TerminateSession(sess, *session.SessionId)
+		return nil, nil, err
+	}
+
+	return dc, session, nil
+}
+
+// StartShellStream runs an interactive shell session with the terminal in raw
+// mode so control characters such as ctrl-c are sent to the remote shell
+func StartShellStream(sess *session.Session, input *ssm.StartSessionInput) error {
+	dc, session, err := OpenSessionStream(sess, input)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := TerminateSession(sess, *session.SessionId)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+	defer dc.Close()
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		stop := WatchTerminalSize(dc, fd)
+		defer stop()
+	}
+
+	go io.Copy(dc, os.Stdin)
+
+	_, err = io.Copy(os.Stdout, dc)
+	if err != nil {
+		return err
+	}
+
+	return dc.Err()
+}
+
+// CmdSessionProxy is run by ssh as the proxy command, it connects stdin and
+// stdout to the session started by the parent bastion process
+func CmdSessionProxy(c *cli.Context) error {
+	streamUrl := os.Getenv(proxyStreamUrlEnv)
+	token := os.Getenv(proxyTokenEnv)
+	if streamUrl == "" || token == "" {
+		return errors.New("session-proxy is run by ssh from start-session --ssh and is not meant to be run directly")
+	}
+
+	dc, err := datachannel.Open(streamUrl, token)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	go func() {
+		io.Copy(dc, os.Stdin)
+		dc.SendFlag(datachannel.DisconnectToPort)
+		dc.Close()
+	}()
+
+	_, err = io.Copy(os.Stdout, dc)
+	if err != nil {
+		return err
+	}
+
+	return dc.Err()
+}
@@ -1,13 +1,15 @@
 package bastion
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"strings"
 
-	"github.com/AlecAivazis/survey/v2"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/urfave/cli/v2"
 )
 
 type subnet struct {
@@ -36,7 +38,7 @@ func GetSubnet(sess *session.Session, subnetId string) (subnet, error) {
 	}
 
 	subnetDetails = subnet{
-		SubnetId:           *resp.Subnets[0].VpcId,
+		SubnetId:           *resp.Subnets[0].SubnetId,
 		Name:               GetTagValue(resp.Subnets[0].Tags, "Name"),
 		Environment:        GetTagValue(resp.Subnets[0].Tags, "Environment"),
 		AvailabilityZone:   *resp.Subnets[0].AvailabilityZone,
@@ -48,44 +50,77 @@ func GetSubnet(sess *session.Session, subnetId string) (subnet, error) {
 	return subnetDetails, nil
 }
 
-func GetSubnets(sess *session.Session) ([]subnet, error) {
+func GetSubnets(sess *session.Session, vpcId string, tagFilters []string) ([]subnet, error) {
 	var subnets []subnet
+	var filters []*ec2.Filter
+
+	if vpcId != "" {
+		filters = append(filters, &ec2.Filter{
+			Name: aws.String("vpc-id"),
+			Values: []*string{
+				aws.String(vpcId),
+			},
+		})
+	}
+
+	for _, tagFilter := range tagFilters {
+		parts := strings.SplitN(tagFilter, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid subnet tag filter %s, must be in the format Key=Value", tagFilter)
+		}
+
+		filters = append(filters, &ec2.Filter{
+			Name: aws.String("tag:" + parts[0]),
+			Values: []*string{
+				aws.String(parts[1]),
+			},
+		})
+	}
+
+	input := &ec2.DescribeSubnetsInput{
+		Filters: filters,
+	}
 
 	client := ec2.New(sess)
-	resp, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{})
+	err := client.DescribeSubnetsPages(input,
+		func(page *ec2.DescribeSubnetsOutput, lastPage bool) bool {
+			for _, v := range page.Subnets {
+				subnets = append(subnets, subnet{
+					SubnetId:           *v.SubnetId,
+					Name:               GetTagValue(v.Tags, "Name"),
+					Environment:        GetTagValue(v.Tags, "Environment"),
+					AvailabilityZone:   *v.AvailabilityZone,
+					AvailabilityZoneId: *v.AvailabilityZoneId,
+					CidrBlock:          *v.CidrBlock,
+					VpcId:              *v.VpcId,
+				})
+			}
+			return true
+		},
+	)
+
 	if err != nil {
 		return nil, err
 	}
 
-	for _, v := range resp.Subnets {
-		subnets = append(subnets, subnet{
-			SubnetId:           *v.SubnetId,
-			Name:               GetTagValue(v.Tags, "Name"),
-			Environment:        GetTagValue(v.Tags, "Environment"),
-			AvailabilityZone:   *v.AvailabilityZone,
-			AvailabilityZoneId: *v.AvailabilityZoneId,
-			CidrBlock:          *v.CidrBlock,
-			VpcId:              *v.VpcId,
-		})
+	if len(subnets) == 0 {
+		return nil, errors.New("no subnets found matching the provided filters")
 	}
 
 	return subnets, nil
 }
 
-func SelectSubnet(subnets []subnet) subnet {
+func SelectSubnet(subnets []subnet, interactive bool) (subnet, error) {
 	var options []string
 	var subnet subnet
 	for _, v := range subnets {
 		options = append(options, fmt.Sprintf("%-25s\t%-40s\t%-20s\t%-10s\t%-10s", v.SubnetId, v.Name, v.AvailabilityZone, v.AvailabilityZoneId, v.CidrBlock))
 	}
 
-	selected := ""
-	prompt := &survey.Select{
-		Message:  "Select a subnet:",
-		Options:  options,
-		PageSize: 25,
+	selected, err := SelectOption("Select a subnet:", options, interactive, "provide --subnet-id or narrow the candidates with --vpc-id and --subnet-tag")
+	if err != nil {
+		return subnet, err
 	}
-	survey.AskOne(prompt, &selected)
 
 	subnetId := strings.Fields(selected)[0]
 	for i := range subnets {
@@ -94,5 +129,79 @@ func SelectSubnet(subnets []subnet) subnet {
 		}
 	}
 
-	return subnet
+	return subnet, nil
+}
+
+// GetLaunchSubnet returns the subnet provided by --subnet-id or selects one
+// from the subnets matching --vpc-id and --subnet-tag
+func GetLaunchSubnet(c *cli.Context, sess *session.Session) (subnet, error) {
+	if c.String("subnet-id") != "" {
+		return GetSubnet(sess, c.String("subnet-id"))
+	}
+
+	subnets, err := GetSubnets(sess, c.String("vpc-id"), c.StringSlice("subnet-tag"))
+	if err != nil {
+		return subnet{}, err
+	}
+
+	return SelectSubnet(subnets, IsInteractive(c))
+}
+
+// SelectTargetSubnet returns a subnet in the vpc of the target for the bastion, subnets in the
+// availability zone of the target are preferred and the selector is only shown if several remain
+func SelectTargetSubnet(c *cli.Context, sess *session.Session, vpcId string, availabilityZone string) (subnet, error) {
+	if c.String("subnet-id") != "" {
+		subnet, err := GetSubnet(sess, c.String("subnet-id"))
+		if err != nil {
+			return subnet, err
+		}
+		if subnet.VpcId != vpcId {
+			return subnet, fmt.Errorf("subnet %s is in %s but the target is in %s", subnet.SubnetId, subnet.VpcId, vpcId)
+		}
+		return subnet, nil
+	}
+
+	if c.String("vpc-id") != "" && c.String("vpc-id") != vpcId {
+		return subnet{}, fmt.Errorf("the target is in %s not %s", vpcId, c.String("vpc-id"))
+	}
+
+	subnets, err := GetSubnets(sess, vpcId, c.StringSlice("subnet-tag"))
+	if err != nil {
+		return subnet{}, err
+	}
+
+	subnets = FilterTargetSubnets(subnets, availabilityZone)
+
+	if len(subnets) == 1 {
+		log.Printf("Launching the bastion in %s %s next to the target", subnets[0].SubnetId, subnets[0].AvailabilityZone)
+		return subnets[0], nil
+	}
+
+	return SelectSubnet(subnets, IsInteractive(c))
+}
+
+// FilterTargetSubnets returns the subnets in the availability zone of the target, or every
+// subnet when none are in that zone or the target doesn't have one
+func FilterTargetSubnets(subnets []subnet, availabilityZone string) []subnet {
+	var sameZone []subnet
+	for _, v := range subnets {
+		if v.AvailabilityZone == availabilityZone {
+			sameZone = append(sameZone, v)
+		}
+	}
+	if len(sameZone) > 0 {
+		return sameZone
+	}
+
+	return subnets
+}
+
+// SetTargetSubnet selects the subnet next to the target and sets --subnet-id so the bastion is launched into it
+func SetTargetSubnet(c *cli.Context, sess *session.Session, vpcId string, availabilityZone string) error {
+	subnet, err := SelectTargetSubnet(c, sess, vpcId, availabilityZone)
+	if err != nil {
+		return err
+	}
+
+	return c.Set("subnet-id", subnet.SubnetId)
 }
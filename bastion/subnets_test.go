@@ -0,0 +1,32 @@
+package bastion
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterTargetSubnets(t *testing.T) {
+	a1 := subnet{SubnetId: "subnet-a1", AvailabilityZone: "ap-southeast-2a"}
+	a2 := subnet{SubnetId: "subnet-a2", AvailabilityZone: "ap-southeast-2a"}
+	b1 := subnet{SubnetId: "subnet-b1", AvailabilityZone: "ap-southeast-2b"}
+
+	tests := []struct {
+		name             string
+		subnets          []subnet
+		availabilityZone string
+		expected         []subnet
+	}{
+		{name: "one subnet in the zone", subnets: []subnet{a1, b1}, availabilityZone: "ap-southeast-2b", expected: []subnet{b1}},
+		{name: "several subnets in the zone", subnets: []subnet{a1, b1, a2}, availabilityZone: "ap-southeast-2a", expected: []subnet{a1, a2}},
+		{name: "no subnets in the zone", subnets: []subnet{a1, b1}, availabilityZone: "ap-southeast-2c", expected: []subnet{a1, b1}},
+		{name: "target without a zone", subnets: []subnet{a1, b1}, availabilityZone: "", expected: []subnet{a1, b1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterTargetSubnets(tt.subnets, tt.availabilityZone); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
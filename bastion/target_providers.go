@@ -0,0 +1,351 @@
+package bastion
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/docdb"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticsearchservice"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/redshift"
+)
+
+// GetElastiCacheEndpoints returns the primary, reader or configuration endpoint of each replication group and
+// the endpoint of each Redis or Memcached cluster that isn't part of a replication group
+func GetElastiCacheEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := elasticache.New(sess)
+	var endpoints []targetEndpoint
+
+	subnetGroups := map[string]string{}
+	err := client.DescribeCacheSubnetGroupsPages(&elasticache.DescribeCacheSubnetGroupsInput{},
+		func(page *elasticache.DescribeCacheSubnetGroupsOutput, lastPage bool) bool {
+			for _, group := range page.CacheSubnetGroups {
+				subnetGroups[aws.StringValue(group.CacheSubnetGroupName)] = aws.StringValue(group.VpcId)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var clusters []*elasticache.CacheCluster
+	clusterIds := map[string]*elasticache.CacheCluster{}
+	err = client.DescribeCacheClustersPages(&elasticache.DescribeCacheClustersInput{ShowCacheNodeInfo: aws.Bool(true)},
+		func(page *elasticache.DescribeCacheClustersOutput, lastPage bool) bool {
+			for _, cluster := range page.CacheClusters {
+				clusters = append(clusters, cluster)
+				clusterIds[aws.StringValue(cluster.CacheClusterId)] = cluster
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	//The vpc, zone and security groups are read from a cluster
+	clusterEndpoint := func(cluster *elasticache.CacheCluster, identifier string, role string, endpoint *elasticache.Endpoint) targetEndpoint {
+		target := targetEndpoint{
+			Identifier:       identifier,
+			Role:             role,
+			Engine:           aws.StringValue(cluster.Engine),
+			Host:             aws.StringValue(endpoint.Address),
+			Port:             aws.Int64Value(endpoint.Port),
+			VpcId:            subnetGroups[aws.StringValue(cluster.CacheSubnetGroupName)],
+			AvailabilityZone: aws.StringValue(cluster.PreferredAvailabilityZone),
+		}
+		for _, group := range cluster.SecurityGroups {
+			target.SecurityGroupIds = append(target.SecurityGroupIds, aws.StringValue(group.SecurityGroupId))
+		}
+		return target
+	}
+
+	grouped := map[string]bool{}
+	err = client.DescribeReplicationGroupsPages(&elasticache.DescribeReplicationGroupsInput{},
+		func(page *elasticache.DescribeReplicationGroupsOutput, lastPage bool) bool {
+			for _, group := range page.ReplicationGroups {
+				for _, member := range group.MemberClusters {
+					grouped[aws.StringValue(member)] = true
+				}
+
+				if len(group.MemberClusters) == 0 {
+					continue
+				}
+				cluster, ok := clusterIds[aws.StringValue(group.MemberClusters[0])]
+				if !ok {
+					continue
+				}
+
+				id := aws.StringValue(group.ReplicationGroupId)
+				if group.ConfigurationEndpoint != nil {
+					endpoints = append(endpoints, clusterEndpoint(cluster, id, "configuration", group.ConfigurationEndpoint))
+					continue
+				}
+
+				if len(group.NodeGroups) == 0 {
+					continue
+				}
+				if group.NodeGroups[0].PrimaryEndpoint != nil {
+					endpoints = append(endpoints, clusterEndpoint(cluster, id, "primary", group.NodeGroups[0].PrimaryEndpoint))
+				}
+				if group.NodeGroups[0].ReaderEndpoint != nil {
+					endpoints = append(endpoints, clusterEndpoint(cluster, id, "reader", group.NodeGroups[0].ReaderEndpoint))
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cluster := range clusters {
+		id := aws.StringValue(cluster.CacheClusterId)
+		if grouped[id] {
+			continue
+		}
+
+		//Memcached clusters have a configuration endpoint, single node Redis clusters only have the node endpoint
+		if cluster.ConfigurationEndpoint != nil {
+			endpoints = append(endpoints, clusterEndpoint(cluster, id, "configuration", cluster.ConfigurationEndpoint))
+		} else if len(cluster.CacheNodes) > 0 && cluster.CacheNodes[0].Endpoint != nil {
+			endpoints = append(endpoints, clusterEndpoint(cluster, id, "node", cluster.CacheNodes[0].Endpoint))
+		}
+	}
+
+	return endpoints, nil
+}
+
+// GetOpenSearchEndpoints returns the endpoint of each OpenSearch or Elasticsearch domain in a vpc,
+// public domains are reachable without a bastion and are skipped
+func GetOpenSearchEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := elasticsearchservice.New(sess)
+	var endpoints []targetEndpoint
+
+	domains, err := client.ListDomainNames(&elasticsearchservice.ListDomainNamesInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []*string
+	for _, domain := range domains.DomainNames {
+		names = append(names, domain.DomainName)
+	}
+
+	//Domains are described five at a time
+	for i := 0; i < len(names); i += 5 {
+		end := i + 5
+		if end > len(names) {
+			end = len(names)
+		}
+
+		resp, err := client.DescribeElasticsearchDomains(&elasticsearchservice.DescribeElasticsearchDomainsInput{
+			DomainNames: names[i:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, domain := range resp.DomainStatusList {
+			if domain.VPCOptions == nil || domain.Endpoints["vpc"] == nil || aws.BoolValue(domain.Deleted) {
+				continue
+			}
+
+			endpoint := targetEndpoint{
+				Identifier:       aws.StringValue(domain.DomainName),
+				Role:             "domain",
+				Engine:           aws.StringValue(domain.ElasticsearchVersion),
+				Host:             aws.StringValue(domain.Endpoints["vpc"]),
+				Port:             443,
+				VpcId:            aws.StringValue(domain.VPCOptions.VPCId),
+				SecurityGroupIds: aws.StringValueSlice(domain.VPCOptions.SecurityGroupIds),
+			}
+			if len(domain.VPCOptions.AvailabilityZones) > 0 {
+				endpoint.AvailabilityZone = aws.StringValue(domain.VPCOptions.AvailabilityZones[0])
+			}
+
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	return endpoints, nil
+}
+
+// GetDocumentDBEndpoints returns the writer and reader endpoint of each DocumentDB cluster
+func GetDocumentDBEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := docdb.New(sess)
+	var endpoints []targetEndpoint
+
+	subnetGroups := map[string]string{}
+	err := client.DescribeDBSubnetGroupsPages(&docdb.DescribeDBSubnetGroupsInput{},
+		func(page *docdb.DescribeDBSubnetGroupsOutput, lastPage bool) bool {
+			for _, group := range page.DBSubnetGroups {
+				subnetGroups[aws.StringValue(group.DBSubnetGroupName)] = aws.StringValue(group.VpcId)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &docdb.DescribeDBClustersInput{
+		Filters: []*docdb.Filter{
+			{
+				Name:   aws.String("engine"),
+				Values: []*string{aws.String("docdb")},
+			},
+		},
+	}
+
+	err = client.DescribeDBClustersPages(input,
+		func(page *docdb.DescribeDBClustersOutput, lastPage bool) bool {
+			for _, cluster := range page.DBClusters {
+				if cluster.Endpoint == nil {
+					continue
+				}
+
+				writer := targetEndpoint{
+					Identifier: aws.StringValue(cluster.DBClusterIdentifier),
+					Role:       "cluster-writer",
+					Engine:     aws.StringValue(cluster.Engine),
+					Host:       aws.StringValue(cluster.Endpoint),
+					Port:       aws.Int64Value(cluster.Port),
+					VpcId:      subnetGroups[aws.StringValue(cluster.DBSubnetGroup)],
+				}
+				for _, group := range cluster.VpcSecurityGroups {
+					writer.SecurityGroupIds = append(writer.SecurityGroupIds, aws.StringValue(group.VpcSecurityGroupId))
+				}
+				endpoints = append(endpoints, writer)
+
+				if cluster.ReaderEndpoint != nil {
+					reader := writer
+					reader.Role = "cluster-reader"
+					reader.Host = aws.StringValue(cluster.ReaderEndpoint)
+					endpoints = append(endpoints, reader)
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// GetRedshiftEndpoints returns the endpoint of each Redshift cluster
+func GetRedshiftEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := redshift.New(sess)
+	var endpoints []targetEndpoint
+
+	err := client.DescribeClustersPages(&redshift.DescribeClustersInput{},
+		func(page *redshift.DescribeClustersOutput, lastPage bool) bool {
+			for _, cluster := range page.Clusters {
+				if cluster.Endpoint == nil {
+					continue
+				}
+
+				endpoint := targetEndpoint{
+					Identifier:       aws.StringValue(cluster.ClusterIdentifier),
+					Role:             "cluster",
+					Engine:           "redshift",
+					Host:             aws.StringValue(cluster.Endpoint.Address),
+					Port:             aws.Int64Value(cluster.Endpoint.Port),
+					VpcId:            aws.StringValue(cluster.VpcId),
+					AvailabilityZone: aws.StringValue(cluster.AvailabilityZone),
+				}
+				for _, group := range cluster.VpcSecurityGroups {
+					endpoint.SecurityGroupIds = append(endpoint.SecurityGroupIds, aws.StringValue(group.VpcSecurityGroupId))
+				}
+
+				endpoints = append(endpoints, endpoint)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// GetMSKEndpoints returns every bootstrap broker of each active MSK cluster, TLS listeners are preferred
+func GetMSKEndpoints(sess *session.Session) ([]targetEndpoint, error) {
+	client := kafka.New(sess)
+	var endpoints []targetEndpoint
+	var clusters []*kafka.ClusterInfo
+
+	err := client.ListClustersPages(&kafka.ListClustersInput{},
+		func(page *kafka.ListClustersOutput, lastPage bool) bool {
+			clusters = append(clusters, page.ClusterInfoList...)
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cluster := range clusters {
+		if aws.StringValue(cluster.State) != "ACTIVE" || cluster.BrokerNodeGroupInfo == nil {
+			continue
+		}
+
+		brokers, err := client.GetBootstrapBrokers(&kafka.GetBootstrapBrokersInput{
+			ClusterArn: cluster.ClusterArn,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var brokerString string
+		for _, v := range []*string{brokers.BootstrapBrokerStringTls, brokers.BootstrapBrokerString, brokers.BootstrapBrokerStringSaslIam, brokers.BootstrapBrokerStringSaslScram} {
+			if aws.StringValue(v) != "" {
+				brokerString = aws.StringValue(v)
+				break
+			}
+		}
+
+		//The brokers are placed in the client subnets which share a vpc
+		var vpcId string
+		if len(cluster.BrokerNodeGroupInfo.ClientSubnets) > 0 {
+			subnet, err := GetSubnet(sess, aws.StringValue(cluster.BrokerNodeGroupInfo.ClientSubnets[0]))
+			if err != nil {
+				return nil, err
+			}
+			vpcId = subnet.VpcId
+		}
+
+		engine := "kafka"
+		if cluster.CurrentBrokerSoftwareInfo != nil {
+			engine += " " + aws.StringValue(cluster.CurrentBrokerSoftwareInfo.KafkaVersion)
+		}
+
+		for _, broker := range strings.Split(brokerString, ",") {
+			host, port, err := net.SplitHostPort(broker)
+			if err != nil {
+				continue
+			}
+			portNumber, _ := strconv.ParseInt(port, 10, 64)
+
+			endpoints = append(endpoints, targetEndpoint{
+				Identifier:       aws.StringValue(cluster.ClusterName),
+				Role:             "broker",
+				Engine:           engine,
+				Host:             host,
+				Port:             portNumber,
+				VpcId:            vpcId,
+				SecurityGroupIds: aws.StringValueSlice(cluster.BrokerNodeGroupInfo.SecurityGroups),
+			})
+		}
+	}
+
+	return endpoints, nil
+}
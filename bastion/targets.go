@@ -0,0 +1,104 @@
+package bastion
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// targetEndpoint is an address of a service the bastion can forward to along with the
+// vpc and security groups needed to place the bastion and allow it to connect
+type targetEndpoint struct {
+	Identifier       string
+	Role             string
+	Engine           string
+	Host             string
+	Port             int64
+	VpcId            string
+	AvailabilityZone string
+	SecurityGroupIds []string
+}
+
+// String includes the host as endpoints such as the brokers of a MSK cluster share every other field
+func (e targetEndpoint) String() string {
+	return fmt.Sprintf("%-40s\t%-16s\t%-18s\t%-5d\t%-21s\t%s", e.Identifier, e.Role, e.Engine, e.Port, e.VpcId, e.Host)
+}
+
+// targetTypes lists the endpoints of each service that can be selected with --target-type
+var targetTypes = map[string]func(sess *session.Session) ([]targetEndpoint, error){
+	"rds":         GetRDSEndpoints,
+	"elasticache": GetElastiCacheEndpoints,
+	"opensearch":  GetOpenSearchEndpoints,
+	"docdb":       GetDocumentDBEndpoints,
+	"redshift":    GetRedshiftEndpoints,
+	"msk":         GetMSKEndpoints,
+}
+
+// targetTypeNames is the order the target types are listed in errors
+var targetTypeNames = []string{"rds", "elasticache", "opensearch", "docdb", "redshift", "msk"}
+
+func GetTargetEndpoints(sess *session.Session, targetType string) ([]targetEndpoint, error) {
+	list, ok := targetTypes[targetType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported target type %s, must be one of %s", targetType, strings.Join(targetTypeNames, ", "))
+	}
+
+	return list(sess)
+}
+
+func SelectTargetEndpoints(sess *session.Session, targetType string, interactive bool) ([]targetEndpoint, error) {
+	///Function to select the endpoints to connect to when neither the remoteHost or target identifier flags are set
+
+	endpoints, err := GetTargetEndpoints(sess, targetType)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no %s endpoints found", targetType)
+	}
+
+	var options []string
+	byOption := map[string]int{}
+	for i, endpoint := range endpoints {
+		option := endpoint.String()
+		options = append(options, option)
+		byOption[option] = i
+	}
+
+	selected, err := SelectOptions(fmt.Sprintf("Select the %s endpoints to connect:", targetType), options, interactive, "provide --target-id or --remote-host")
+	if err != nil {
+		return nil, err
+	}
+
+	var selectedEndpoints []targetEndpoint
+	for _, option := range selected {
+		selectedEndpoints = append(selectedEndpoints, endpoints[byOption[option]])
+	}
+
+	return selectedEndpoints, nil
+}
+
+// GetTargetEndpoint finds the endpoint by its address or by the identifier of the instance, cluster or
+// domain. An identifier shared by several endpoints connects to the first listed, such as a cluster writer
+func GetTargetEndpoint(sess *session.Session, targetType string, identifier string) (targetEndpoint, error) {
+	endpoints, err := GetTargetEndpoints(sess, targetType)
+	if err != nil {
+		return targetEndpoint{}, err
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint.Host == identifier {
+			return endpoint, nil
+		}
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint.Identifier == identifier {
+			return endpoint, nil
+		}
+	}
+
+	return targetEndpoint{}, fmt.Errorf("no %s endpoint found matching %s", targetType, identifier)
+}
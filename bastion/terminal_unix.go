@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package bastion
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/base2Services/bastion-cli/bastion/datachannel"
+	"golang.org/x/term"
+)
+
+// WatchTerminalSize sends the terminal size to the session now and whenever the window is resized
+func WatchTerminalSize(dc *datachannel.DataChannel, fd int) func() {
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	resize <- syscall.SIGWINCH
+
+	go func() {
+		for range resize {
+			cols, rows, err := term.GetSize(fd)
+			if err == nil {
+				dc.SetSize(cols, rows)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(resize)
+		close(resize)
+	}
+}
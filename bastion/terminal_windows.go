@@ -0,0 +1,38 @@
+package bastion
+
+import (
+	"time"
+
+	"github.com/base2Services/bastion-cli/bastion/datachannel"
+	"golang.org/x/term"
+)
+
+// WatchTerminalSize polls for changes to the console size as windows has no resize signal
+func WatchTerminalSize(dc *datachannel.DataChannel, fd int) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+
+		lastCols, lastRows := 0, 0
+		for {
+			cols, rows, err := term.GetSize(fd)
+			if err == nil && (cols != lastCols || rows != lastRows) {
+				if dc.SetSize(cols, rows) == nil {
+					lastCols, lastRows = cols, rows
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,621 @@
+package bastion
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/urfave/cli/v2"
+)
+
+// tunnelDaemonEnv is set on the detached process started by tunnel up
+const tunnelDaemonEnv = "BASTION_TUNNEL_DAEMON"
+
+// tunnelState is written to the state dir by the tunnel process so the tunnel
+// can be listed and torn down from another terminal
+type tunnelState struct {
+	Name               string              `json:"name"`
+	Tunnels            []string            `json:"tunnels,omitempty"`
+	Pid                int                 `json:"pid"`
+	Status             string              `json:"status"`
+	Region             string              `json:"region"`
+	Profile            string              `json:"profile"`
+	SessionId          string              `json:"session_id"`
+	InstanceId         string              `json:"instance_id"`
+	Reused             bool                `json:"reused,omitempty"`
+	Forwards           []portForward       `json:"forwards"`
+	SecurityGroupRules []securityGroupRule `json:"security_group_rules"`
+	StartedAt          time.Time           `json:"started_at"`
+}
+
+// GetStateDir returns ~/.local/state/bastion or the equivalent under $XDG_STATE_HOME
+func GetStateDir() (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(stateHome, "bastion"), nil
+}
+
+// GetTunnelStateDir returns ~/.local/state/bastion/tunnels or the equivalent under $XDG_STATE_HOME
+func GetTunnelStateDir() (string, error) {
+	dir, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tunnels"), nil
+}
+
+func GetTunnelStatePath(name string) (string, error) {
+	dir, err := GetTunnelStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+func GetTunnelLogPath(name string) (string, error) {
+	dir, err := GetTunnelStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".log"), nil
+}
+
+func ReadTunnelState(name string) (*tunnelState, error) {
+	path, err := GetTunnelStatePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &tunnelState{}
+	err = json.Unmarshal(b, state)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse tunnel state %s, %s", path, err)
+	}
+
+	return state, nil
+}
+
+// WriteTunnelState replaces the state file in a single rename so readers never see a partial file
+func WriteTunnelState(state *tunnelState) error {
+	path, err := GetTunnelStatePath(state.Name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func RemoveTunnelState(name string) error {
+	path, err := GetTunnelStatePath(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// GetTunnelStates returns the state of every tunnel sorted by name
+func GetTunnelStates() ([]*tunnelState, error) {
+	dir, err := GetTunnelStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*tunnelState
+	for _, path := range paths {
+		state, err := ReadTunnelState(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+
+	return states, nil
+}
+
+// CmdTunnelUp starts the port forward in a detached process and returns once the tunnel is ready,
+// named tunnels from the tunnels file are started with a detached process for each bastion they share
+func CmdTunnelUp(c *cli.Context) error {
+	name := c.String("name")
+	if os.Getenv(tunnelDaemonEnv) != "" {
+		return RunTunnel(c, name)
+	}
+
+	if c.Args().Present() {
+		return StartNamedTunnels(c)
+	}
+
+	if name == "" {
+		name = "tunnel-" + GenerateSessionId()[:8]
+	}
+
+	if state, err := ReadTunnelState(name); err == nil && IsProcessRunning(state.Pid) {
+		return fmt.Errorf("tunnel %s is already running, stop it with bastion tunnel down %s", name, name)
+	}
+
+	// the name is passed to the daemon in case it was generated
+	return StartTunnelProcess(name, append([]string{"--name", name}, TunnelUpArgs(os.Args[1:])...))
+}
+
+// StartNamedTunnels resolves the named tunnels and starts a tunnel process for
+// each group of tunnels with the same preset in the same vpc
+func StartNamedTunnels(c *cli.Context) error {
+	names := c.Args().Slice()
+	args := TunnelUpArgs(os.Args[1:])
+	flags := args[:len(args)-len(names)]
+
+	definitions, err := GetTunnelDefinitions(c, names)
+	if err != nil {
+		return err
+	}
+
+	var presets []string
+	byPreset := map[string][]string{}
+	for _, name := range names {
+		preset := definitions[name].Preset
+		if _, ok := byPreset[preset]; !ok {
+			presets = append(presets, preset)
+		}
+		byPreset[preset] = append(byPreset[preset], name)
+	}
+
+	//Every target is resolved before starting any tunnel so clashing local ports are caught up front
+	var allTargets []tunnelTarget
+	byPresetTargets := map[string][]tunnelTarget{}
+	for _, preset := range presets {
+		sess, err := GetPresetSession(c, preset)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range byPreset[preset] {
+			target, err := ResolveTunnelTarget(sess, name, definitions[name])
+			if err != nil {
+				return err
+			}
+			byPresetTargets[preset] = append(byPresetTargets[preset], target)
+			allTargets = append(allTargets, target)
+		}
+	}
+
+	err = CheckTunnelLocalPorts(allTargets)
+	if err != nil {
+		return err
+	}
+
+	for _, preset := range presets {
+		for _, group := range GroupTunnelTargets(byPresetTargets[preset]) {
+			var groupNames []string
+			for _, target := range group {
+				groupNames = append(groupNames, target.Name)
+			}
+			groupName := strings.Join(groupNames, "+")
+
+			if state, err := ReadTunnelState(groupName); err == nil && IsProcessRunning(state.Pid) {
+				log.Printf("tunnel %s is already running", groupName)
+				continue
+			}
+
+			groupArgs := append(append([]string{}, flags...), "--name", groupName)
+			if preset != "" {
+				groupArgs = append(groupArgs, "--preset", preset)
+			}
+			groupArgs = append(groupArgs, groupNames...)
+
+			err = StartTunnelProcess(groupName, groupArgs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetPresetSession creates an AWS session with the region and profile from the preset, falling back to the flags
+func GetPresetSession(c *cli.Context, preset string) (*session.Session, error) {
+	region := c.String("region")
+	profile := c.String("profile")
+
+	if preset != "" {
+		configs, err := LoadConfigFiles()
+		if err != nil {
+			return nil, err
+		}
+
+		resolved, err := ResolveConfig(configs, preset, "")
+		if err != nil {
+			return nil, err
+		}
+
+		if v, ok := resolved["region"]; ok {
+			region = v.Value()
+		}
+		if v, ok := resolved["profile"]; ok {
+			profile = v.Value()
+		}
+	}
+
+	return SetupAWSSession(region, profile), nil
+}
+
+// StartTunnelProcess runs tunnel up again with the arguments as a detached process with its
+// output written to the tunnel log, it waits until the tunnel is ready or the process exits
+func StartTunnelProcess(name string, args []string) error {
+	logPath, err := GetTunnelLogPath(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(logPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, append([]string{"tunnel", "up"}, args...)...)
+	cmd.Env = append(os.Environ(), tunnelDaemonEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = DetachedProcessAttributes()
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	log.Printf("Starting tunnel %s, the log is written to %s", name, logPath)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exited:
+			output, _ := ioutil.ReadFile(logPath)
+			return fmt.Errorf("tunnel %s failed to start:\n%s", name, strings.TrimSpace(string(output)))
+		case <-ticker.C:
+			state, err := ReadTunnelState(name)
+			if err == nil && state.Status == "ready" && state.Pid == cmd.Process.Pid {
+				PrintTunnelForwards(state)
+				log.Printf("Tunnel %s is ready, stop it with bastion tunnel down %s", name, name)
+				return nil
+			}
+		}
+	}
+}
+
+// TunnelUpArgs returns the arguments following the tunnel up command
+func TunnelUpArgs(args []string) []string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "tunnel" && args[i+1] == "up" {
+			return args[i+2:]
+		}
+	}
+	return nil
+}
+
+// RunTunnel runs in the detached process, it records what it creates in the
+// state file and tears everything down when it is stopped
+func RunTunnel(c *cli.Context, name string) (err error) {
+	sess := SetupAWSSession(c.String("region"), c.String("profile"))
+
+	state := &tunnelState{
+		Name:      name,
+		Pid:       os.Getpid(),
+		Status:    "starting",
+		Region:    *sess.Config.Region,
+		Profile:   c.String("profile"),
+		StartedAt: time.Now().UTC(),
+	}
+
+	err = WriteTunnelState(state)
+	if err != nil {
+		return err
+	}
+
+	rollback := NewCleanupStack()
+	defer func() {
+		rollback.Finish(c.Bool("no-terminate"))
+
+		removeErr := RemoveTunnelState(name)
+		if err == nil {
+			err = removeErr
+		}
+	}()
+
+	var instance portForwardInstance
+	if c.Args().Present() {
+		state.Tunnels = c.Args().Slice()
+		instance, state.Forwards, state.SecurityGroupRules, err = PrepareNamedTunnels(c, sess, rollback, state.Tunnels)
+	} else {
+		instance, state.Forwards, state.SecurityGroupRules, err = PrepareRemotePortForward(c, sess, rollback)
+	}
+	if err != nil {
+		return err
+	}
+
+	state.InstanceId = instance.InstanceId
+	state.SessionId = instance.SessionId
+	state.Reused = !instance.Launched
+
+	//The tunnel is only ready once sessions can be started on the bastion
+	err = WaitForBastionReachable(rollback.Context(), sess, state.InstanceId)
+	if err != nil {
+		return err
+	}
+
+	forwarder := NewPortForwarder(sess, state.InstanceId, state.Forwards)
+	err = forwarder.Start()
+	if err != nil {
+		return err
+	}
+	rollback.Launched()
+
+	state.Status = "ready"
+	err = WriteTunnelState(state)
+	if err != nil {
+		forwarder.Close()
+		return err
+	}
+
+	// tunnel down stops the process which cancels the context
+	<-rollback.Context().Done()
+	log.Printf("Stopping tunnel %s", name)
+
+	forwarder.Close()
+	return nil
+}
+
+func CmdTunnelList(c *cli.Context) error {
+	states, err := GetTunnelStates()
+	if err != nil {
+		return err
+	}
+
+	if len(states) == 0 {
+		log.Println("no tunnels found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tPID\tBASTION\tSESSION ID\tFORWARDS\tSTARTED")
+
+	for _, state := range states {
+		status := state.Status
+		if !IsProcessRunning(state.Pid) {
+			status = "stopped"
+		}
+
+		var forwards []string
+		for _, forward := range state.Forwards {
+			forwards = append(forwards, forward.String())
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", state.Name, status, state.Pid, state.InstanceId,
+			state.SessionId, strings.Join(forwards, ", "), state.StartedAt.Local().Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+func CmdTunnelDown(c *cli.Context) error {
+	var names []string
+
+	if c.Bool("all") {
+		states, err := GetTunnelStates()
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			names = append(names, state.Name)
+		}
+	} else {
+		for _, name := range c.Args().Slice() {
+			names = append(names, FindTunnelStateName(name))
+		}
+	}
+
+	if len(names) == 0 {
+		return errors.New("provide the names of the tunnels to stop or --all")
+	}
+
+	failed := 0
+	for _, name := range names {
+		err := StopTunnel(name)
+		if err != nil {
+			log.Printf("failed to stop tunnel %s, %s", name, err)
+			failed++
+			continue
+		}
+		log.Printf("Stopped tunnel %s", name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to stop %d tunnels", failed)
+	}
+
+	return nil
+}
+
+// FindTunnelStateName returns the tunnel sharing a bastion with the named tunnel from the tunnels file
+func FindTunnelStateName(name string) string {
+	states, err := GetTunnelStates()
+	if err != nil {
+		return name
+	}
+
+	for _, state := range states {
+		if state.Name == name {
+			return name
+		}
+	}
+
+	for _, state := range states {
+		for _, tunnel := range state.Tunnels {
+			if tunnel == name {
+				return state.Name
+			}
+		}
+	}
+
+	return name
+}
+
+// StopTunnel stops the tunnel process and waits for it to tear down its resources, anything
+// left behind by a process that could not clean up is removed using the state file
+func StopTunnel(name string) error {
+	state, err := ReadTunnelState(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("tunnel %s not found", name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if IsProcessRunning(state.Pid) {
+		err = StopProcess(state.Pid)
+		if err != nil {
+			return err
+		}
+
+		// allow time for the sessions to close and the bastion to be terminated
+		for i := 0; i < 120 && IsProcessRunning(state.Pid); i++ {
+			time.Sleep(time.Second)
+		}
+
+		if IsProcessRunning(state.Pid) {
+			return fmt.Errorf("tunnel process %d did not exit", state.Pid)
+		}
+	}
+
+	state, err = ReadTunnelState(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Cleaning up the resources recorded for tunnel %s", name)
+
+	err = TeardownTunnel(state)
+	if err != nil {
+		return err
+	}
+
+	return RemoveTunnelState(name)
+}
+
+// TeardownTunnel reverts the security group rules and terminates the bastion recorded in the state
+func TeardownTunnel(state *tunnelState) error {
+	sess := SetupAWSSession(state.Region, state.Profile)
+
+	for _, rule := range state.SecurityGroupRules {
+		err := ReleaseSecurityGroupRule(sess, rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Instances the tunnel didn't launch are left running along with their security groups
+	if state.Reused {
+		return nil
+	}
+
+	if state.InstanceId != "" {
+		err := TerminateEC2(sess, state.InstanceId)
+		if err != nil && !IsNotFoundError(err) {
+			return err
+		}
+	}
+
+	//The security group created for the session is deleted once the bastion has terminated
+	if state.SessionId != "" {
+		groups, err := GetSessionSecurityGroupIds(sess, state.SessionId)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			err = DeleteSecurityGroup(sess, group)
+			if err != nil && !IsNotFoundError(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func PrintTunnelForwards(state *tunnelState) {
+	for _, forward := range state.Forwards {
+		fmt.Println(forward)
+	}
+}
@@ -0,0 +1,346 @@
+package bastion
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// tunnelDefinition is a named tunnel in the tunnels file, exactly one target is set
+type tunnelDefinition struct {
+	RDSIdentifier string `yaml:"rds-identifier"`
+	ElastiCacheId string `yaml:"elasticache-id"`
+	TargetType    string `yaml:"target-type"`
+	TargetId      string `yaml:"target-id"`
+	Host          string `yaml:"host"`
+	Tag           string `yaml:"tag"`
+	RemotePort    string `yaml:"remote-port"`
+	LocalPort     string `yaml:"local-port"`
+	Preset        string `yaml:"preset"`
+}
+
+type tunnelsFile struct {
+	Path    string                      `yaml:"-"`
+	Tunnels map[string]tunnelDefinition `yaml:"tunnels"`
+}
+
+// tunnelTarget is a tunnel definition resolved to the host and port the bastion
+// connects to, the vpc, zone and security group are empty for plain hosts
+type tunnelTarget struct {
+	Name             string
+	Host             string
+	RemotePort       string
+	LocalPort        string
+	VpcId            string
+	AvailabilityZone string
+	SecurityGroupIds []string
+}
+
+// GetTunnelsFilePath returns the --tunnels-file flag or tunnels.yaml next to the user config file
+func GetTunnelsFilePath(c *cli.Context) (string, error) {
+	if c.String("tunnels-file") != "" {
+		return c.String("tunnels-file"), nil
+	}
+
+	configPath, err := GetUserConfigPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(configPath), "tunnels.yaml"), nil
+}
+
+func ReadTunnelsFile(path string) (*tunnelsFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels := &tunnelsFile{Path: path}
+	err = yaml.Unmarshal(b, tunnels)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse tunnels file %s, %s", path, err)
+	}
+
+	for name, definition := range tunnels.Tunnels {
+		err = ValidateTunnelDefinition(definition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel %s in %s, %s", name, path, err)
+		}
+	}
+
+	return tunnels, nil
+}
+
+func ValidateTunnelDefinition(definition tunnelDefinition) error {
+	targets := 0
+	for _, target := range []string{definition.RDSIdentifier, definition.ElastiCacheId, definition.TargetId, definition.Host, definition.Tag} {
+		if target != "" {
+			targets++
+		}
+	}
+
+	if targets != 1 {
+		return errors.New("set exactly one of rds-identifier, elasticache-id, target-id, host or tag")
+	}
+
+	if definition.TargetType != "" && definition.TargetId == "" {
+		return errors.New("target-type is only used with target-id")
+	}
+
+	if definition.RemotePort == "" && (definition.Host != "" || definition.Tag != "") {
+		return errors.New("remote-port is required for host and tag targets")
+	}
+
+	if definition.Tag != "" && !strings.Contains(definition.Tag, "=") {
+		return errors.New("tag must be in the form key=value")
+	}
+
+	for field, port := range map[string]string{"remote-port": definition.RemotePort, "local-port": definition.LocalPort} {
+		if port == "" {
+			continue
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%s %s is not a valid port", field, port)
+		}
+	}
+
+	return nil
+}
+
+// GetTunnelDefinitions looks up the named tunnels in the tunnels file
+func GetTunnelDefinitions(c *cli.Context, names []string) (map[string]tunnelDefinition, error) {
+	path, err := GetTunnelsFilePath(c)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels, err := ReadTunnelsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := map[string]tunnelDefinition{}
+	for _, name := range names {
+		definition, ok := tunnels.Tunnels[name]
+		if !ok {
+			return nil, fmt.Errorf("tunnel %s not found in %s", name, path)
+		}
+		definitions[name] = definition
+	}
+
+	return definitions, nil
+}
+
+// ResolveTunnelTarget looks up the host, port, vpc and security group of the tunnel target
+func ResolveTunnelTarget(sess *session.Session, name string, definition tunnelDefinition) (tunnelTarget, error) {
+	target := tunnelTarget{
+		Name:       name,
+		Host:       definition.Host,
+		RemotePort: definition.RemotePort,
+	}
+	var err error
+
+	switch {
+	case definition.RDSIdentifier != "":
+		err = resolveEndpointTarget(sess, "rds", definition.RDSIdentifier, &target)
+	case definition.ElastiCacheId != "":
+		err = resolveEndpointTarget(sess, "elasticache", definition.ElastiCacheId, &target)
+	case definition.TargetId != "":
+		targetType := definition.TargetType
+		if targetType == "" {
+			targetType = "rds"
+		}
+		err = resolveEndpointTarget(sess, targetType, definition.TargetId, &target)
+	case definition.Tag != "":
+		err = resolveInstanceTarget(sess, definition.Tag, &target)
+	}
+	if err != nil {
+		return tunnelTarget{}, fmt.Errorf("unable to resolve tunnel %s, %s", name, err)
+	}
+
+	// the explicit remote port takes precedence over the endpoint port
+	if definition.RemotePort != "" {
+		target.RemotePort = definition.RemotePort
+	}
+
+	target.LocalPort = definition.LocalPort
+	if target.LocalPort == "" {
+		target.LocalPort = target.RemotePort
+	}
+
+	return target, nil
+}
+
+// resolveEndpointTarget connects to the endpoint of the target type matching the identifier
+func resolveEndpointTarget(sess *session.Session, targetType string, identifier string, target *tunnelTarget) error {
+	endpoint, err := GetTargetEndpoint(sess, targetType, identifier)
+	if err != nil {
+		return err
+	}
+
+	target.Host = endpoint.Host
+	target.RemotePort = strconv.FormatInt(endpoint.Port, 10)
+	target.AvailabilityZone = endpoint.AvailabilityZone
+	target.VpcId = endpoint.VpcId
+	target.SecurityGroupIds = endpoint.SecurityGroupIds
+
+	return nil
+}
+
+// resolveInstanceTarget connects to the private address of the first running instance with the tag
+func resolveInstanceTarget(sess *session.Session, tag string, target *tunnelTarget) error {
+	client := ec2.New(sess)
+	parts := strings.SplitN(tag, "=", 2)
+
+	resp, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + parts[0]),
+				Values: []*string{aws.String(parts[1])},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []*string{aws.String("running")},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			target.Host = aws.StringValue(instance.PrivateIpAddress)
+			target.VpcId = aws.StringValue(instance.VpcId)
+			if instance.Placement != nil {
+				target.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+			}
+			for _, group := range instance.SecurityGroups {
+				target.SecurityGroupIds = append(target.SecurityGroupIds, aws.StringValue(group.GroupId))
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no running instances found with tag %s", tag)
+}
+
+// CheckTunnelLocalPorts rejects targets forwarded from the same local port, the local port
+// defaults to the remote port so targets of the same engine clash unless local-port is set
+func CheckTunnelLocalPorts(targets []tunnelTarget) error {
+	byPort := map[string]string{}
+	for _, target := range targets {
+		if other, ok := byPort[target.LocalPort]; ok {
+			return fmt.Errorf("tunnels %s and %s both use local port %s, set local-port for one of them in the tunnels file", other, target.Name, target.LocalPort)
+		}
+		byPort[target.LocalPort] = target.Name
+	}
+
+	return nil
+}
+
+// GroupTunnelTargets groups the targets that can share a bastion, targets
+// without a vpc join the first group so they don't launch a bastion of their own
+func GroupTunnelTargets(targets []tunnelTarget) [][]tunnelTarget {
+	var groups [][]tunnelTarget
+	index := map[string]int{}
+
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].VpcId != "" && targets[j].VpcId == ""
+	})
+
+	for _, target := range targets {
+		vpcId := target.VpcId
+		if vpcId == "" && len(groups) > 0 {
+			groups[0] = append(groups[0], target)
+			continue
+		}
+
+		if i, ok := index[vpcId]; ok {
+			groups[i] = append(groups[i], target)
+			continue
+		}
+
+		index[vpcId] = len(groups)
+		groups = append(groups, []tunnelTarget{target})
+	}
+
+	return groups
+}
+
+// PrepareNamedTunnels launches the bastion next to the targets, or uses an existing instance, and allows it
+// to connect to each of them, it returns the same values as PrepareRemotePortForward
+func PrepareNamedTunnels(c *cli.Context, sess *session.Session, rollback *cleanupStack, names []string) (portForwardInstance, []portForward, []securityGroupRule, error) {
+	var (
+		rules    []securityGroupRule
+		forwards []portForward
+	)
+
+	definitions, err := GetTunnelDefinitions(c, names)
+	if err != nil {
+		return portForwardInstance{}, nil, nil, err
+	}
+
+	var targets []tunnelTarget
+	for _, name := range names {
+		target, err := ResolveTunnelTarget(sess, name, definitions[name])
+		if err != nil {
+			return portForwardInstance{}, nil, nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	err = CheckTunnelLocalPorts(targets)
+	if err != nil {
+		return portForwardInstance{}, nil, nil, err
+	}
+
+	//The bastion is placed next to the first target, the targets were grouped by vpc when the tunnel was started
+	var vpcId, availabilityZone string
+	for _, target := range targets {
+		if target.VpcId != "" {
+			vpcId, availabilityZone = target.VpcId, target.AvailabilityZone
+			break
+		}
+	}
+
+	err = RevokeStaleSecurityGroupRules(sess, c.String("region"), c.String("profile"))
+	if err != nil {
+		log.Printf("unable to revoke stale security group rules, %s", err)
+	}
+
+	instance, err := GetPortForwardInstance(c, sess, rollback, vpcId, availabilityZone)
+	if err != nil {
+		return portForwardInstance{}, nil, nil, err
+	}
+	journal := NewSecurityGroupJournal(c.String("region"), c.String("profile"), instance.SessionId)
+
+	for _, target := range targets {
+		port, err := strconv.ParseInt(target.RemotePort, 10, 64)
+		if err != nil {
+			return portForwardInstance{}, nil, nil, fmt.Errorf("invalid remote port %s for tunnel %s", target.RemotePort, target.Name)
+		}
+
+		rules, err = AllowBastionIngress(sess, rollback, journal, rules, target.SecurityGroupIds, instance.SecurityGroupId, port)
+		if err != nil {
+			return portForwardInstance{}, nil, nil, err
+		}
+
+		forwards = append(forwards, portForward{LocalPort: target.LocalPort, RemoteHost: target.Host, RemotePort: target.RemotePort})
+	}
+
+	return instance, forwards, rules, nil
+}
@@ -0,0 +1,53 @@
+package bastion
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTunnelLocalPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []tunnelTarget
+		err     string
+	}{
+		{
+			name: "distinct ports",
+			targets: []tunnelTarget{
+				{Name: "orders", LocalPort: "5432"},
+				{Name: "billing", LocalPort: "5433"},
+				{Name: "cache", LocalPort: "6379"},
+			},
+		},
+		{
+			name: "same local port",
+			targets: []tunnelTarget{
+				{Name: "orders", LocalPort: "5432"},
+				{Name: "cache", LocalPort: "6379"},
+				{Name: "billing", LocalPort: "5432"},
+			},
+			err: "tunnels orders and billing both use local port 5432",
+		},
+		{
+			name: "single tunnel",
+			targets: []tunnelTarget{
+				{Name: "orders", LocalPort: "5432"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckTunnelLocalPorts(tt.targets)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package bastion
 
 import (
+	"fmt"
 	"log"
+	"os"
 	"strings"
 
+	"github.com/AlecAivazis/survey/v2"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/mattn/go-isatty"
+	"github.com/urfave/cli/v2"
 )
 
 func GetTagValue(tags []*ec2.Tag, key string) string {
@@ -51,3 +57,71 @@ func SetupAWSSession(region string, profile string) *session.Session {
 
 	return session.Must(session.NewSessionWithOptions(opts))
 }
+
+// IsInteractive reports whether selectors can prompt the user, prompts are
+// disabled with --non-interactive or when stdin is not a terminal
+func IsInteractive(c *cli.Context) bool {
+	if c.Bool("non-interactive") {
+		return false
+	}
+	return isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd())
+}
+
+// SelectOption prompts the user to pick one of the options. When not interactive
+// a single option is selected automatically, otherwise an error listing the
+// options and a hint on how to choose one from the command line is returned
+func SelectOption(message string, options []string, interactive bool, hint string) (string, error) {
+	if !interactive {
+		if len(options) == 1 {
+			return options[0], nil
+		}
+		return "", fmt.Errorf("%d candidates found and prompts are disabled, %s:\n  %s", len(options), hint, strings.Join(options, "\n  "))
+	}
+
+	selected := ""
+	prompt := &survey.Select{
+		Message:  message,
+		Options:  options,
+		PageSize: 25,
+	}
+
+	err := survey.AskOne(prompt, &selected)
+	if err != nil {
+		return "", err
+	}
+
+	return selected, nil
+}
+
+// SelectOptions prompts for one or more options, when prompts are disabled
+// a single candidate is selected otherwise the candidates are returned in the error
+func SelectOptions(message string, options []string, interactive bool, hint string) ([]string, error) {
+	if !interactive {
+		if len(options) == 1 {
+			return options, nil
+		}
+		return nil, fmt.Errorf("%d candidates found and prompts are disabled, %s:\n  %s", len(options), hint, strings.Join(options, "\n  "))
+	}
+
+	var selected []string
+	prompt := &survey.MultiSelect{
+		Message:  message,
+		Options:  options,
+		PageSize: 25,
+	}
+
+	err := survey.AskOne(prompt, &selected, survey.WithValidator(survey.Required))
+	if err != nil {
+		return nil, err
+	}
+
+	return selected, nil
+}
+
+// IsNotFoundError is true when the AWS resource no longer exists
+func IsNotFoundError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return strings.HasSuffix(aerr.Code(), ".NotFound")
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package entrypoint
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+// awsFlags select the AWS credentials, region and config file preset of every command that calls AWS
+func awsFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "region",
+			Aliases: []string{"r"},
+			EnvVars: []string{"BASTION_REGION", "AWS_REGION"},
+			Usage:   "AWS region",
+		},
+		&cli.StringFlag{
+			Name:    "profile",
+			Aliases: []string{"p"},
+			EnvVars: []string{"BASTION_PROFILE", "AWS_PROFILE"},
+			Usage:   "AWS profile",
+		},
+		&cli.StringFlag{
+			Name:    "preset",
+			EnvVars: []string{"BASTION_PRESET"},
+			Usage:   "apply the named preset from the bastion config file",
+		},
+	}
+}
+
+// nonInteractiveFlags are the options of commands that can prompt with a selector
+func nonInteractiveFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "non-interactive",
+			EnvVars: []string{"BASTION_NON_INTERACTIVE"},
+			Usage:   "never prompt, fail with a list of candidates instead. Enabled automatically when stdin is not a terminal",
+		},
+	}
+}
+
+// sessionClientFlags are the options of commands whose sessions can be started with the session manager plugin
+func sessionClientFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "session-manager-plugin",
+			EnvVars: []string{"BASTION_SESSION_MANAGER_PLUGIN"},
+			Usage:   "use the AWS session manager plugin instead of the built in session client",
+		},
+	}
+}
+
+// portForwardTargetFlags select what port-forward and tunnel up forward to
+func portForwardTargetFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "remote-port",
+			EnvVars: []string{"BASTION_REMOTE_PORT"},
+			Usage:   "remote port, defaults to the port of the RDS endpoint. Required with remote-host",
+		},
+		&cli.StringFlag{
+			Name:    "local-port",
+			EnvVars: []string{"BASTION_LOCAL_PORT"},
+			Usage:   "local port",
+		},
+		&cli.StringFlag{
+			Name:    "remote-host",
+			EnvVars: []string{"BASTION_REMOTE_HOST"},
+			Usage:   "remote host",
+		},
+		&cli.StringSliceFlag{
+			Name:    "rds-identifier",
+			EnvVars: []string{"BASTION_RDS_IDENTIFIER"},
+			Usage:   "RDS instance, Aurora cluster, cluster endpoint or RDS Proxy identifier or endpoint address to forward to, can be repeated. Each endpoint is forwarded from the next local port. A selector will pop up if neither this, remote-host or forward are provided",
+		},
+		&cli.StringFlag{
+			Name:    "target-type",
+			EnvVars: []string{"BASTION_TARGET_TYPE"},
+			Value:   "rds",
+			Usage:   "type of target to forward to [rds, elasticache, opensearch, docdb, redshift, msk]",
+		},
+		&cli.StringSliceFlag{
+			Name:    "target-id",
+			EnvVars: []string{"BASTION_TARGET_ID"},
+			Usage:   "identifier or endpoint address of the target to forward to, can be repeated. A selector will pop up if neither this, remote-host or forward are provided",
+		},
+		&cli.StringSliceFlag{
+			Name:    "forward",
+			Aliases: []string{"L"},
+			EnvVars: []string{"BASTION_FORWARD"},
+			Usage:   "forward a local port to a host and port reachable from the bastion as local-port:host:remote-port, can be repeated",
+		},
+	}
+}
+
+// existingInstanceFlags forward through a running instance instead of launching a bastion
+func existingInstanceFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "instance-id",
+			EnvVars: []string{"BASTION_INSTANCE_ID"},
+			Usage:   "forward through an existing EC2 instance instead of launching a bastion, it is left running on exit",
+		},
+		&cli.StringFlag{
+			Name:    "session-id",
+			EnvVars: []string{"BASTION_SESSION_ID"},
+			Usage:   "forward through the running bastion with this session id instead of launching a bastion, it is left running on exit",
+		},
+		&cli.BoolFlag{
+			Name:    "reuse",
+			EnvVars: []string{"BASTION_REUSE"},
+			Usage:   "forward through a running bastion you launched with --no-terminate in the target's VPC, a bastion is launched if none is found",
+		},
+	}
+}
+
+// launchDefaults are the launch option defaults that differ between the commands that create a bastion
+type launchDefaults struct {
+	Ami                    string
+	AmiDescription         string
+	InstanceType           string
+	EphemeralSecurityGroup bool
+}
+
+var linuxLaunchDefaults = launchDefaults{
+	Ami:            "amazon-linux",
+	AmiDescription: "the latest amazon linux 2",
+	InstanceType:   "t3.micro",
+}
+
+var windowsLaunchDefaults = launchDefaults{
+	Ami:            "windows",
+	AmiDescription: "the latest Windows 2019 Base",
+	InstanceType:   "t3.small",
+}
+
+// portForwardLaunchDefaults launch the bastion with its own security group as it only needs to connect out
+var portForwardLaunchDefaults = launchDefaults{
+	Ami:                    linuxLaunchDefaults.Ami,
+	AmiDescription:         linuxLaunchDefaults.AmiDescription,
+	InstanceType:           linuxLaunchDefaults.InstanceType,
+	EphemeralSecurityGroup: true,
+}
+
+// launchFlags are the sizing, storage, networking and lifecycle options of every command that creates a bastion
+func launchFlags(defaults launchDefaults) []cli.Flag {
+	ephemeralSecurityGroupUsage := "create a security group for the bastion with no inbound rules that is deleted when the bastion terminates, ignored when security-group-id is provided"
+	if defaults.EphemeralSecurityGroup {
+		ephemeralSecurityGroupUsage += ", disable with --ephemeral-security-group=false"
+	}
+
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "ami",
+			EnvVars: []string{"BASTION_AMI"},
+			Value:   defaults.Ami,
+			Usage:   "Amazon machine image (AMI) id or a SSM parameter path containing an AMI. Defaults to " + defaults.AmiDescription,
+		},
+		&cli.StringFlag{
+			Name:    "subnet-id",
+			Aliases: []string{"s"},
+			EnvVars: []string{"BASTION_SUBNET_ID"},
+			Usage:   "subnet-id to launch the bastion in, a selector will pop up if none provided",
+		},
+		&cli.StringFlag{
+			Name:    "vpc-id",
+			EnvVars: []string{"BASTION_VPC_ID"},
+			Usage:   "only select from subnets in this VPC",
+		},
+		&cli.StringSliceFlag{
+			Name:    "subnet-tag",
+			EnvVars: []string{"BASTION_SUBNET_TAG"},
+			Usage:   "only select from subnets with a matching tag in the format Key=Value, wildcards are supported eg: Name=private-*",
+		},
+		&cli.StringFlag{
+			Name:    "security-group-id",
+			Aliases: []string{"sg"},
+			EnvVars: []string{"BASTION_SECURITY_GROUP_ID"},
+			Usage:   "security-group-id to launch the bastion with, specify `default` to use the default security group. A selector will pop up if none provided",
+		},
+		&cli.BoolFlag{
+			Name:    "ephemeral-security-group",
+			EnvVars: []string{"BASTION_EPHEMERAL_SECURITY_GROUP"},
+			Value:   defaults.EphemeralSecurityGroup,
+			Usage:   ephemeralSecurityGroupUsage,
+		},
+		&cli.StringFlag{
+			Name:    "instance-type",
+			Aliases: []string{"t"},
+			EnvVars: []string{"BASTION_INSTANCE_TYPE"},
+			Value:   defaults.InstanceType,
+			Usage:   "Amazon EC2 instance type",
+		},
+		&cli.BoolFlag{
+			Name:    "no-spot",
+			EnvVars: []string{"BASTION_NO_SPOT"},
+			Usage:   "set to use on-demand EC2 pricing",
+		},
+		&cli.BoolFlag{
+			Name:    "private",
+			EnvVars: []string{"BASTION_PRIVATE"},
+			Usage:   "don't attach a public IP to the bastion",
+		},
+		&cli.IntFlag{
+			Name:    "expire-after",
+			Aliases: []string{"ex"},
+			EnvVars: []string{"BASTION_EXPIRE_AFTER"},
+			Value:   120,
+			Usage:   "bastion instance will terminate after this period of time",
+		},
+		&cli.BoolFlag{
+			Name:    "no-expire",
+			EnvVars: []string{"BASTION_NO_EXPIRE"},
+			Usage:   "disable expiry of the bastion instance",
+		},
+		&cli.DurationFlag{
+			Name:    "idle-timeout",
+			EnvVars: []string{"BASTION_IDLE_TIMEOUT"},
+			Usage:   "terminate the bastion instance after it has had no active sessions for this duration eg: 30m, disabled by default",
+		},
+		&cli.BoolFlag{
+			Name:    "no-terminate",
+			EnvVars: []string{"BASTION_NO_TERMINATE"},
+			Usage:   "disable automatic termination of the bastion instance when the session disconnects",
+		},
+		&cli.Int64Flag{
+			Name:    "volume-size",
+			EnvVars: []string{"BASTION_VOLUME_SIZE"},
+			Value:   8,
+			Usage:   "specify volume size in GB",
+		},
+		&cli.BoolFlag{
+			Name:    "no-volume-encryption",
+			EnvVars: []string{"BASTION_NO_VOLUME_ENCRYPTION"},
+			Usage:   "launch the bastion with an unencrypted root volume, volumes are encrypted by default",
+		},
+		&cli.BoolFlag{
+			Name:    "volume-encryption",
+			EnvVars: []string{"BASTION_VOLUME_ENCRYPTION"},
+			Usage:   "deprecated, use --no-volume-encryption",
+			Hidden:  true,
+		},
+		&cli.StringFlag{
+			Name:    "volume-type",
+			EnvVars: []string{"BASTION_VOLUME_TYPE"},
+			Usage:   "specify volume type [gp2, gp3, io2, io1]",
+		},
+	}
+}
+
+// linuxLaunchFlags are the options applied by the linux userdata
+func linuxLaunchFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "efs",
+			EnvVars: []string{"BASTION_EFS"},
+			Usage:   "EFS file system id to mount to the bastion instance",
+		},
+		&cli.StringFlag{
+			Name:    "access-points",
+			EnvVars: []string{"BASTION_ACCESS_POINTS"},
+			Usage:   "Comma-delimited list of access-point ids to mount to the bastion instance",
+		},
+		&cli.StringFlag{
+			Name:    "ssh-key",
+			Aliases: []string{"k"},
+			EnvVars: []string{"BASTION_SSH_KEY"},
+			Usage:   "add a public key to the authorized_users file in the bastions user home directory",
+		},
+		&cli.StringFlag{
+			Name:    "ssh-user",
+			Aliases: []string{"u"},
+			EnvVars: []string{"BASTION_SSH_USER"},
+			Value:   "ec2-user",
+			Usage:   "shh user",
+		},
+	}
+}
+
+// flags joins the flag sets of a command
+func flags(sets ...[]cli.Flag) []cli.Flag {
+	var joined []cli.Flag
+	for _, set := range sets {
+		joined = append(joined, set...)
+	}
+	return joined
+}
@@ -22,294 +22,200 @@ func CliMain() {
 				Name:   "launch",
 				Usage:  "launch an new bastion instance",
 				Action: bastion.CmdLaunchLinuxBastion,
-				Before: bastion.CheckRequirements,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "region",
-						Aliases: []string{"r"},
-						Usage:   "AWS region",
-					},
-					&cli.StringFlag{
-						Name:    "profile",
-						Aliases: []string{"p"},
-						Usage:   "AWS profile",
-					},
-					&cli.StringFlag{
-						Name:  "ami",
-						Value: "amazon-linux",
-						Usage: "Amazon machine image (AMI) id or a SSM parameter path containing an AMI. Defaults to the latest amazon linux 2",
-					},
-					&cli.StringFlag{
-						Name:    "subnet-id",
-						Aliases: []string{"s"},
-						Usage:   "subnet-id to launch the bastion in, a selector will pop up if none provided",
-					},
-					&cli.StringFlag{
-						Name:    "security-group-id",
-						Aliases: []string{"sg"},
-						Usage:   "security-group-id to launch the bastion with, specify `default` to use the default security group. A selector will pop up if none provided",
-					},
-					&cli.StringFlag{
-						Name:    "instance-type",
-						Aliases: []string{"t"},
-						Value:   "t3.micro",
-						Usage:   "Amazon EC2 instance type",
-					},
-					&cli.BoolFlag{
-						Name:  "no-spot",
-						Usage: "set to use on-demand EC2 pricing",
-					},
-					&cli.BoolFlag{
-						Name:  "private",
-						Usage: "don't attach a public IP to the bastion",
-					},
-					&cli.StringFlag{
-						Name:  "efs",
-						Usage: "EFS file system id to mount to the bastion instance",
-					},
-					&cli.StringFlag{
-						Name:  "access-points",
-						Usage: "Comma-delimited list of access-point ids to mount to the bastion instance",
-					},
-					&cli.IntFlag{
-						Name:    "expire-after",
-						Aliases: []string{"ex"},
-						Value:   120,
-						Usage:   "bastion instance will terminate after this period of time",
-					},
-					&cli.BoolFlag{
-						Name:  "no-expire",
-						Usage: "disable expiry of the bastion instance",
-					},
-					&cli.BoolFlag{
-						Name:  "no-terminate",
-						Usage: "disable automatic termination of the bastion instance when the session disconnects",
-					},
-					&cli.BoolFlag{
-						Name:  "ssh",
-						Usage: "start a ssh session through AWS session manager, this will require a ssh public on the bastion instance",
-					},
-					&cli.StringFlag{
-						Name:    "ssh-key",
-						Aliases: []string{"k"},
-						Usage:   "add a public key to the authorized_users file in the bastions user home directory",
-					},
-					&cli.StringFlag{
-						Name:    "ssh-user",
-						Aliases: []string{"u"},
-						Value:   "ec2-user",
-						Usage:   "shh user",
-					},
-					&cli.StringFlag{
-						Name:    "ssh-opts",
-						Aliases: []string{"o"},
-						Usage:   "any additional ssh options such as tunnels '-L 3306:db.internal.example.com:3306'",
-					},
-					&cli.Int64Flag{
-						Name:  "volume-size",
-						Value: 8,
-						Usage: "specify volume size in GB",
-					},
-					&cli.BoolFlag{
-						Name:  "volume-encryption",
-						Usage: "enable volume encryption",
-					},
-					&cli.StringFlag{
-						Name:  "volume-type",
-						Usage: "specify volume type [gp2, gp3, io2, io1]",
-					},
-				},
+				Before: chain(bastion.ApplyConfig, bastion.CheckRequirements),
+				Flags: flags(
+					awsFlags(),
+					nonInteractiveFlags(),
+					sessionClientFlags(),
+					[]cli.Flag{
+						&cli.BoolFlag{
+							Name:    "ssh",
+							EnvVars: []string{"BASTION_SSH"},
+							Usage:   "start a ssh session through AWS session manager, this will require a ssh public on the bastion instance",
+						},
+						&cli.StringFlag{
+							Name:    "ssh-opts",
+							Aliases: []string{"o"},
+							EnvVars: []string{"BASTION_SSH_OPTS"},
+							Usage:   "any additional ssh options such as tunnels '-L 3306:db.internal.example.com:3306'",
+						},
+					},
+					launchFlags(linuxLaunchDefaults),
+					linuxLaunchFlags(),
+				),
 			},
 			{
 				Name:   "launch-windows",
 				Usage:  "launch an new windows bastion instance",
 				Action: bastion.CmdLaunchWindowsBastion,
-				Before: bastion.CheckRequirements,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "region",
-						Aliases: []string{"r"},
-						Usage:   "AWS region",
-					},
-					&cli.StringFlag{
-						Name:    "profile",
-						Aliases: []string{"p"},
-						Usage:   "AWS profile",
-					},
-					&cli.StringFlag{
-						Name:  "ami",
-						Value: "windows",
-						Usage: "Amazon machine image (AMI) id or a SSM parameter path containing an AMI. Defaults to the latest Windows 2019 Base",
-					},
-					&cli.StringFlag{
-						Name:    "subnet-id",
-						Aliases: []string{"s"},
-						Usage:   "subnet-id to launch the bastion in, a selector will pop up if none provided",
-					},
-					&cli.StringFlag{
-						Name:    "security-group-id",
-						Aliases: []string{"sg"},
-						Usage:   "security-group-id to launch the bastion with, specify `default` to use the default security group. A selector will pop up if none provided",
-					},
-					&cli.IntFlag{
-						Name:    "local-port",
-						Aliases: []string{"l"},
-						Usage:   "local rdp port to use to connect to the rdp session, defaults to a random port",
-					},
-					&cli.StringFlag{
-						Name:    "instance-type",
-						Aliases: []string{"t"},
-						Value:   "t3.small",
-						Usage:   "Amazon EC2 instance type",
-					},
-					&cli.BoolFlag{
-						Name:  "rdp",
-						Usage: "start a rdp session and launch your remote desktop client",
-					},
-					&cli.BoolFlag{
-						Name:  "no-terminate",
-						Usage: "disable automatic termination of the bastion instance when the session disconnects",
-					},
-					&cli.BoolFlag{
-						Name:  "no-spot",
-						Usage: "set to use on-demand EC2 pricing",
-					},
-					&cli.BoolFlag{
-						Name:  "private",
-						Usage: "don't attach a public IP to the bastion",
-					},
-					&cli.Int64Flag{
-						Name:  "volume-size",
-						Value: 8,
-						Usage: "specify volume size in GB",
-					},
-					&cli.BoolFlag{
-						Name:  "volume-encryption",
-						Usage: "enable volume encryption",
-					},
-					&cli.StringFlag{
-						Name:  "volume-type",
-						Usage: "specify volume type [gp2, gp3, io2, io1]",
-					},
-				},
+				Before: chain(bastion.ApplyConfig, bastion.CheckRequirements),
+				Flags: flags(
+					awsFlags(),
+					nonInteractiveFlags(),
+					sessionClientFlags(),
+					[]cli.Flag{
+						&cli.IntFlag{
+							Name:    "local-port",
+							Aliases: []string{"l"},
+							EnvVars: []string{"BASTION_LOCAL_PORT"},
+							Usage:   "local rdp port to use to connect to the rdp session, defaults to a random port",
+						},
+						&cli.BoolFlag{
+							Name:    "rdp",
+							EnvVars: []string{"BASTION_RDP"},
+							Usage:   "start a rdp session and launch your remote desktop client",
+						},
+					},
+					launchFlags(windowsLaunchDefaults),
+				),
 			},
 			{
 				Name:   "start-session",
 				Usage:  "start a session with an existing instance",
 				Action: bastion.CmdStartSession,
-				Before: bastion.CheckRequirements,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "region",
-						Aliases: []string{"r"},
-						Usage:   "AWS region",
-					},
-					&cli.StringFlag{
-						Name:    "profile",
-						Aliases: []string{"p"},
-						Usage:   "AWS profile",
-					},
-					&cli.StringFlag{
-						Name:    "instance-id",
-						Aliases: []string{"i"},
-						Usage:   "connect to a specific EC2 instance",
-					},
-					&cli.StringFlag{
-						Name:    "session-id",
-						Aliases: []string{"s"},
-						Usage:   "connect to a specific bastion session",
-					},
-					&cli.BoolFlag{
-						Name:  "ssh",
-						Usage: "start a ssh session through AWS session manager, this will require a ssh public on the bastion instance",
-					},
-					&cli.StringFlag{
-						Name:    "ssh-user",
-						Aliases: []string{"u"},
-						Value:   "ec2-user",
-						Usage:   "shh user",
-					},
-					&cli.StringFlag{
-						Name:    "ssh-opts",
-						Aliases: []string{"o"},
-						Usage:   "any additional ssh options such as tunnels '-L 3306:db.internal.example.com:3306'",
-					},
-					&cli.BoolFlag{
-						Name:  "rdp",
-						Usage: "start a rdp session and launch your remote desktop client",
-					},
-					&cli.StringFlag{
-						Name:  "keypair-parameter",
-						Usage: "retrieve a windows password using a provate key stored in SSM parameter store to start a rdp session",
-					},
-				},
+				Before: chain(bastion.ApplyConfig, bastion.CheckRequirements),
+				Flags: flags(
+					awsFlags(),
+					nonInteractiveFlags(),
+					sessionClientFlags(),
+					[]cli.Flag{
+						&cli.StringFlag{
+							Name:    "instance-id",
+							Aliases: []string{"i"},
+							EnvVars: []string{"BASTION_INSTANCE_ID"},
+							Usage:   "connect to a specific EC2 instance",
+						},
+						&cli.StringFlag{
+							Name:    "session-id",
+							Aliases: []string{"s"},
+							EnvVars: []string{"BASTION_SESSION_ID"},
+							Usage:   "connect to a specific bastion session",
+						},
+						&cli.BoolFlag{
+							Name:    "ssh",
+							EnvVars: []string{"BASTION_SSH"},
+							Usage:   "start a ssh session through AWS session manager, this will require a ssh public on the bastion instance",
+						},
+						&cli.StringFlag{
+							Name:    "ssh-user",
+							Aliases: []string{"u"},
+							EnvVars: []string{"BASTION_SSH_USER"},
+							Value:   "ec2-user",
+							Usage:   "shh user",
+						},
+						&cli.StringFlag{
+							Name:    "ssh-opts",
+							Aliases: []string{"o"},
+							EnvVars: []string{"BASTION_SSH_OPTS"},
+							Usage:   "any additional ssh options such as tunnels '-L 3306:db.internal.example.com:3306'",
+						},
+						&cli.BoolFlag{
+							Name:    "rdp",
+							EnvVars: []string{"BASTION_RDP"},
+							Usage:   "start a rdp session and launch your remote desktop client",
+						},
+						&cli.StringFlag{
+							Name:    "keypair-parameter",
+							EnvVars: []string{"BASTION_KEYPAIR_PARAMETER"},
+							Usage:   "retrieve a windows password using a provate key stored in SSM parameter store to start a rdp session",
+						},
+					},
+				),
 			},
 			{
-				Name:   "port-forward",
-				Usage:  "setup a remote port forward to an RDS instance",
-				Action: bastion.CmdStartRemotePortForwardSession,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:     "remote-port",
-						Usage:    "remote port",
-						Required: true,
-					},
-					&cli.StringFlag{
-						Name:  "local-port",
-						Usage: "local port",
-					},
-					&cli.StringFlag{
-						Name:  "remote-host",
-						Usage: "remote host",
-					},
-					&cli.StringFlag{
-						Name:    "region",
-						Aliases: []string{"r"},
-						Usage:   "AWS region",
-					},
-					&cli.StringFlag{
-						Name:    "profile",
-						Aliases: []string{"p"},
-						Usage:   "AWS profile",
-					},
-					&cli.StringFlag{
-						Name:  "ami",
-						Value: "amazon-linux",
-						Usage: "Amazon machine image (AMI) id or a SSM parameter path containing an AMI. Defaults to the latest amazon linux 2",
-					},
-					&cli.StringFlag{
-						Name:    "subnet-id",
-						Aliases: []string{"s"},
-						Usage:   "subnet-id to launch the bastion in, a selector will pop up if none provided",
-					},
-					&cli.StringFlag{
-						Name:    "security-group-id",
-						Aliases: []string{"sg"},
-						Usage:   "security-group-id to launch the bastion with, specify `default` to use the default security group. A selector will pop up if none provided",
-					},
-					&cli.StringFlag{
-						Name:    "instance-type",
-						Aliases: []string{"t"},
-						Value:   "t3.micro",
-						Usage:   "Amazon EC2 instance type",
-					},
-					&cli.BoolFlag{
-						Name:  "no-spot",
-						Usage: "set to use on-demand EC2 pricing",
-					},
-					&cli.BoolFlag{
-						Name:  "private",
-						Usage: "don't attach a public IP to the bastion",
-					},
-					&cli.IntFlag{
-						Name:    "expire-after",
-						Aliases: []string{"ex"},
-						Value:   120,
-						Usage:   "bastion instance will terminate after this period of time",
-					},
-					&cli.BoolFlag{
-						Name:  "no-expire",
-						Usage: "disable expiry of the bastion instance",
+				Name:      "port-forward",
+				Usage:     "setup a remote port forward to an RDS endpoint or other target",
+				ArgsUsage: "[-- command [args...]]",
+				Action:    bastion.CmdStartRemotePortForwardSession,
+				Before:    chain(bastion.ApplyConfig, bastion.CheckRequirements),
+				Flags: flags(
+					portForwardTargetFlags(),
+					awsFlags(),
+					nonInteractiveFlags(),
+					sessionClientFlags(),
+					existingInstanceFlags(),
+					launchFlags(portForwardLaunchDefaults),
+					linuxLaunchFlags(),
+				),
+			},
+			{
+				Name:      "kube",
+				Usage:     "setup a port forward to a private EKS API endpoint with a temporary kubeconfig",
+				ArgsUsage: "[-- command [args...]]",
+				Action:    bastion.CmdKube,
+				Before:    chain(bastion.ApplyConfig, bastion.CheckRequirements),
+				Flags: flags(
+					[]cli.Flag{
+						&cli.StringFlag{
+							Name:    "cluster",
+							Aliases: []string{"c"},
+							EnvVars: []string{"BASTION_CLUSTER"},
+							Usage:   "EKS cluster name, a selector will pop up if none provided",
+						},
+						&cli.StringFlag{
+							Name:    "local-port",
+							Aliases: []string{"l"},
+							EnvVars: []string{"BASTION_LOCAL_PORT"},
+							Value:   "6443",
+							Usage:   "local port the kubeconfig connects to",
+						},
+					},
+					awsFlags(),
+					nonInteractiveFlags(),
+					sessionClientFlags(),
+					existingInstanceFlags(),
+					launchFlags(portForwardLaunchDefaults),
+					linuxLaunchFlags(),
+				),
+			},
+			{
+				Name:  "tunnel",
+				Usage: "run port forwards in the background",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "up",
+						Usage:     "start a port forward in the background, takes the same flags as port-forward or the names of tunnels from the tunnels file",
+						ArgsUsage: "[tunnel...]",
+						Action:    bastion.CmdTunnelUp,
+						Before:    bastion.ApplyConfig,
+						Flags: flags(
+							[]cli.Flag{
+								&cli.StringFlag{
+									Name:    "name",
+									Aliases: []string{"n"},
+									EnvVars: []string{"BASTION_NAME"},
+									Usage:   "name of the tunnel, generated if not provided",
+								},
+								&cli.StringFlag{
+									Name:    "tunnels-file",
+									EnvVars: []string{"BASTION_TUNNELS_FILE"},
+									Usage:   "file defining named tunnels, defaults to tunnels.yaml in the bastion config directory",
+								},
+							},
+							portForwardTargetFlags(),
+							awsFlags(),
+							existingInstanceFlags(),
+							launchFlags(portForwardLaunchDefaults),
+							linuxLaunchFlags(),
+						),
+					},
+					{
+						Name:   "list",
+						Usage:  "list the background tunnels",
+						Action: bastion.CmdTunnelList,
+					},
+					{
+						Name:      "down",
+						Usage:     "stop background tunnels, reverting their security group changes and terminating their bastions",
+						ArgsUsage: "[name...]",
+						Action:    bastion.CmdTunnelDown,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:    "all",
+								EnvVars: []string{"BASTION_ALL"},
+								Usage:   "stop every tunnel",
+							},
+						},
 					},
 				},
 			},
@@ -317,22 +223,122 @@ func CliMain() {
 				Name:   "terminate",
 				Usage:  "terminate a bastion instance",
 				Action: bastion.CmdTerminateInstance,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "region",
-						Aliases: []string{"r"},
-						Usage:   "AWS region",
-					},
-					&cli.StringFlag{
-						Name:    "profile",
-						Aliases: []string{"p"},
-						Usage:   "AWS profile",
-					},
-					&cli.StringFlag{
-						Name:     "session-id",
-						Aliases:  []string{"s"},
-						Required: true,
-						Usage:    "bastion session id",
+				Before: bastion.ApplyConfig,
+				Flags: flags(
+					awsFlags(),
+					[]cli.Flag{
+						&cli.StringFlag{
+							Name:     "session-id",
+							Aliases:  []string{"s"},
+							EnvVars:  []string{"BASTION_SESSION_ID"},
+							Required: true,
+							Usage:    "bastion session id",
+						},
+					},
+				),
+			},
+			{
+				Name:   "extend",
+				Usage:  "extend or cancel the expiry of a running bastion",
+				Action: bastion.CmdExtendExpiry,
+				Before: bastion.ApplyConfig,
+				Flags: flags(
+					awsFlags(),
+					[]cli.Flag{
+						&cli.StringFlag{
+							Name:    "session-id",
+							Aliases: []string{"s"},
+							EnvVars: []string{"BASTION_SESSION_ID"},
+							Usage:   "bastion session id",
+						},
+						&cli.StringFlag{
+							Name:    "instance-id",
+							Aliases: []string{"i"},
+							EnvVars: []string{"BASTION_INSTANCE_ID"},
+							Usage:   "bastion instance id",
+						},
+						&cli.IntFlag{
+							Name:    "minutes",
+							Aliases: []string{"m"},
+							EnvVars: []string{"BASTION_MINUTES"},
+							Value:   60,
+							Usage:   "number of minutes to add to the bastion expiry",
+						},
+						&cli.BoolFlag{
+							Name:    "cancel",
+							EnvVars: []string{"BASTION_CANCEL"},
+							Usage:   "cancel the expiry of the bastion",
+						},
+					},
+				),
+			},
+			{
+				Name:   "list",
+				Usage:  "list bastion instances",
+				Action: bastion.CmdListBastions,
+				Before: bastion.ApplyConfig,
+				Flags: flags(
+					awsFlags(),
+					[]cli.Flag{
+						&cli.BoolFlag{
+							Name:    "mine",
+							EnvVars: []string{"BASTION_MINE"},
+							Usage:   "only list bastions launched by the current IAM identity",
+						},
+						&cli.StringFlag{
+							Name:    "state",
+							EnvVars: []string{"BASTION_STATE"},
+							Value:   "pending,running",
+							Usage:   "comma-delimited list of instance states to filter by, specify `all` to list bastions in any state",
+						},
+						&cli.StringFlag{
+							Name:    "output",
+							Aliases: []string{"o"},
+							EnvVars: []string{"BASTION_OUTPUT"},
+							Value:   "table",
+							Usage:   "output format [table, json, csv]",
+						},
+					},
+				),
+			},
+			{
+				Name:   "gc",
+				Usage:  "find and clean up resources left behind by bastions that no longer exist",
+				Action: bastion.CmdGarbageCollect,
+				Before: bastion.ApplyConfig,
+				Flags: flags(
+					awsFlags(),
+					[]cli.Flag{
+						&cli.BoolFlag{
+							Name:    "apply",
+							EnvVars: []string{"BASTION_APPLY"},
+							Usage:   "delete the orphaned resources, by default they are only reported",
+						},
+					},
+				),
+			},
+			{
+				Name:   "update-iam-policy",
+				Usage:  "add the actions required by this version to a bastion IAM policy created by an older version",
+				Action: bastion.CmdUpdateIAMPolicy,
+				Before: bastion.ApplyConfig,
+				Flags:  awsFlags(),
+			},
+			{
+				Name:   "session-proxy",
+				Usage:  "connect stdin and stdout to a session, used by ssh as the proxy command",
+				Hidden: true,
+				Action: bastion.CmdSessionProxy,
+			},
+			{
+				Name:  "config",
+				Usage: "inspect the bastion config file",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "show",
+						Usage:  "print the resolved config values and where each came from",
+						Action: bastion.CmdShowConfig,
+						Flags:  awsFlags(),
 					},
 				},
 			},
@@ -344,3 +350,16 @@ func CliMain() {
 		log.Fatal("[ERROR] ", err)
 	}
 }
+
+// chain runs each before hook in order, stopping at the first error
+func chain(funcs ...cli.BeforeFunc) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		for _, f := range funcs {
+			err := f(c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -9,8 +9,12 @@ require (
 	github.com/aws/aws-sdk-go v1.38.65
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
 	github.com/google/uuid v1.3.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/manifoldco/promptui v0.8.0
+	github.com/mattn/go-isatty v0.0.8
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/urfave/cli/v2 v2.3.0
 	golang.org/x/sys v0.0.0-20220907062415-87db552b00fd // indirect
+	golang.org/x/term v0.0.0-20220722155259-a9ba230a4035
+	gopkg.in/yaml.v3 v3.0.1
 )